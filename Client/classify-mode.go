@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// A thread is classified either as one text, all messages concatenated, or
+// message by message. Long threads often drift between topics, so in the
+// message mode the scores of the messages are combined into the thread's
+// scores by one of the combine strategies.
+const (
+	threadMode  = "thread"
+	messageMode = "message"
+
+	// combineLatest takes the scores of the last message with text
+	combineLatest = "latest"
+	// combineLength averages the scores weighted by the number of words
+	// of each message
+	combineLength = "length"
+	// combineMax takes the highest score of each category in any message
+	combineMax = "max"
+)
+
+var classifyModes = []string{threadMode, messageMode}
+
+var combineStrategies = []string{combineLatest, combineLength, combineMax}
+
+// classifyOptions choose how a thread is classified.
+type classifyOptions struct {
+	Mode    string
+	Combine string
+}
+
+// defaultClassifyOptions are the options given with -classify-mode and
+// -combine.
+func defaultClassifyOptions() classifyOptions {
+	return classifyOptions{Mode: *classifyMode, Combine: *combineStrategy}
+}
+
+func (o classifyOptions) validate() error {
+	if !containsString(classifyModes, o.Mode) {
+		return fmt.Errorf("unknown classification mode %q, use one of %s", o.Mode, strings.Join(classifyModes, ", "))
+	}
+	if !containsString(combineStrategies, o.Combine) {
+		return fmt.Errorf("unknown combine strategy %q, use one of %s", o.Combine, strings.Join(combineStrategies, ", "))
+	}
+	return nil
+}
+
+// Params returns the options as URL query parameters.
+func (o classifyOptions) Params() template.URL {
+	v := url.Values{}
+	v.Set("mode", o.Mode)
+	v.Set("combine", o.Combine)
+	return template.URL(v.Encode())
+}
+
+// classifyOptionsFrom reads the mode and combine parameters of a request,
+// falling back to the defaults.
+func classifyOptionsFrom(r *http.Request) (classifyOptions, error) {
+	opts := defaultClassifyOptions()
+	if mode := r.FormValue("mode"); len(mode) > 0 {
+		opts.Mode = mode
+	}
+	if combine := r.FormValue("combine"); len(combine) > 0 {
+		opts.Combine = combine
+	}
+	if err := opts.validate(); err != nil {
+		return opts, newWebError(http.StatusBadRequest, err.Error(), nil)
+	}
+	return opts, nil
+}
+
+// classifierText is a text sent to the classifier. Message is the number of
+// the message it is from, counted from 1, or 0 for the text of the thread.
+type classifierText struct {
+	Message int
+	Text    string
+}
+
+// classifierTexts returns what is classified for mails as opts say: the text
+// of the thread, or in the message mode the text of every message with text
+// of its own. Threads where no message has any fall back to the thread text.
+func classifierTexts(mails []MailMessage, opts classifyOptions) []classifierText {
+	if opts.Mode == messageMode && len(mails) >= 2 {
+		texts := []classifierText{}
+		for i, msg := range mails {
+			if text := cleanMailText(msg.Body); len(text) > 0 {
+				texts = append(texts, classifierText{i + 1, text})
+			}
+		}
+		if len(texts) > 0 {
+			return texts
+		}
+	}
+	return []classifierText{{0, threadText(mails)}}
+}
+
+// textScores classifies the texts of classifierTexts. In the message mode
+// the scores of each message are returned as well, nil for messages without
+// text.
+func textScores(mails []MailMessage, opts classifyOptions) ([]ClassificationResult, [][]ClassificationResult, error) {
+	texts := classifierTexts(mails, opts)
+	if texts[0].Message == 0 {
+		results, err := getClassification(texts[0].Text)
+		return results, nil, err
+	}
+
+	perMessage := make([][]ClassificationResult, len(mails))
+	words := make([]int, len(mails))
+	for _, text := range texts {
+		results, err := getClassification(text.Text)
+		if err != nil {
+			return nil, nil, err
+		}
+		perMessage[text.Message-1] = results
+		words[text.Message-1] = len(strings.Fields(text.Text))
+	}
+
+	results := combineScores(perMessage, words, opts.Combine)
+	if len(results) == 0 {
+		// the classifier knows no category for any message, classify the
+		// thread
+		var err error
+		results, err = getClassification(threadText(mails))
+		return results, perMessage, err
+	}
+	return results, perMessage, nil
+}
+
+// combineScores combines the scores of the messages of a thread into the
+// five most likely categories of the thread. A category missing in the
+// results of a message has a score of 0 there.
+func combineScores(perMessage [][]ClassificationResult, words []int, strategy string) []ClassificationResult {
+	scores := map[string]float64{}
+	switch strategy {
+	case combineLatest:
+		for i := len(perMessage) - 1; i >= 0; i-- {
+			if perMessage[i] != nil {
+				return perMessage[i]
+			}
+		}
+	case combineLength:
+		total := 0
+		for i, results := range perMessage {
+			if results != nil {
+				total += words[i]
+			}
+		}
+		for i, results := range perMessage {
+			for _, result := range results {
+				scores[result.Category] += result.Score * float64(words[i]) / float64(total)
+			}
+		}
+	case combineMax:
+		for _, results := range perMessage {
+			for _, result := range results {
+				if score, ok := scores[result.Category]; !ok || result.Score > score {
+					scores[result.Category] = result.Score
+				}
+			}
+		}
+	}
+
+	combined := []ClassificationResult{}
+	for category, score := range scores {
+		combined = append(combined, ClassificationResult{category, score})
+	}
+	sort.Slice(combined, func(i, j int) bool {
+		if combined[i].Score != combined[j].Score {
+			return combined[i].Score > combined[j].Score
+		}
+		return combined[i].Category < combined[j].Category
+	})
+	if len(combined) > 5 {
+		combined = combined[:5]
+	}
+	return combined
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassifierTexts(t *testing.T) {
+	mails := []MailMessage{
+		{Body: "Shall we meet on Tuesday?"},
+		{Body: "> Shall we meet on Tuesday?", Short: "quoted only"},
+		{Body: "Yes, at noon.\n\nOn Mon, Jane <jane@example.com> wrote:\n> Shall we meet on Tuesday?"},
+	}
+	tests := []struct {
+		name  string
+		mails []MailMessage
+		mode  string
+		want  []classifierText
+	}{
+		{"thread", mails, threadMode, []classifierText{{0, " Shall we meet on Tuesday? Yes, at noon."}}},
+		{"message", mails, messageMode, []classifierText{{1, "Shall we meet on Tuesday?"}, {3, "Yes, at noon."}}},
+		{"single message", mails[:1], messageMode, []classifierText{{0, " Shall we meet on Tuesday?"}}},
+		{"no message with text", []MailMessage{{Short: "a"}, {Short: "b"}}, messageMode, []classifierText{{0, "a"}}},
+	}
+	for _, tt := range tests {
+		got := classifierTexts(tt.mails, classifyOptions{Mode: tt.mode, Combine: combineLatest})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: classifierTexts = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
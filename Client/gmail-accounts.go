@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// splitAccountPath splits a path like "/gmailView/<account>/<rest>" into the
+// account and the rest.
+func splitAccountPath(path, prefix string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// accountFile returns the name of a per-account data file, e.g.
+// "classify-job-me%40example.com.json".
+func accountFile(prefix, account string) string {
+	return prefix + "-" + url.QueryEscape(account) + ".json"
+}
+
+// listGmailAccounts returns the email addresses of all accounts with a stored
+// token.
+func listGmailAccounts() []string {
+	accounts := []string{}
+	dir, err := tokenCacheDir()
+	if err != nil {
+		return accounts
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		if account, err := url.QueryUnescape(strings.TrimSuffix(file.Name(), ".json")); err == nil {
+			accounts = append(accounts, account)
+		}
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// gmailAccountOf asks Gmail for the email address the client is authorized
+// for.
+func gmailAccountOf(client *http.Client) (string, error) {
+	srv, err := newGmailService(client)
+	if err != nil {
+		return "", err
+	}
+	var profile *gmail.Profile
+	err = gmailDo(gmailGetProfile, func() (err error) {
+		profile, err = srv.Users.GetProfile("me").Do()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return profile.EmailAddress, nil
+}
+
+// migrateLegacyToken moves the token of the old single account setup
+// (~/.credentials/gmail-fetcher.json) and its bulk job to the account it
+// belongs to. It runs once at startup, the account shows up in the lists once
+// Gmail told which one it is.
+func migrateLegacyToken() {
+	usr, err := user.Current()
+	if err != nil {
+		return
+	}
+	name := "gmail-fetcher.json"
+	if *writeLabels {
+		name = "gmail-fetcher-modify.json"
+	}
+	legacyFile := filepath.Join(usr.HomeDir, ".credentials", url.QueryEscape(name))
+	tok, err := tokenFromFile(legacyFile)
+	if err != nil {
+		return
+	}
+
+	config, err := gmailConfig()
+	if err != nil {
+		return
+	}
+	account, err := gmailAccountOf(config.Client(context.Background(), tok))
+	if err != nil {
+		log.Printf("Unable to find the account of %s: %v", legacyFile, err)
+		return
+	}
+
+	cacheFile, err := tokenCacheFile(account)
+	if err != nil {
+		return
+	}
+	if err := saveToken(cacheFile, tok); err != nil {
+		log.Printf("Unable to move the stored Gmail token: %v", err)
+		return
+	}
+	os.Remove(legacyFile)
+
+	for _, prefix := range []string{classifyJobFile, classifyResultsFile} {
+		if _, err := os.Stat(accountFile(prefix, account)); os.IsNotExist(err) {
+			os.Rename(prefix+".json", accountFile(prefix, account))
+		}
+	}
+	log.Printf("Moved the stored Gmail token to account %s", account)
+}
+
+// redirectToAccount sends requests without an account in the path to the
+// only account there is, or lets the user pick one.
+func redirectToAccount(w http.ResponseWriter, r *http.Request, prefix string) {
+	accounts := listGmailAccounts()
+	switch len(accounts) {
+	case 0:
+		http.Redirect(w, r, "/gmailLogin/", http.StatusSeeOther)
+	case 1:
+		http.Redirect(w, r, prefix+accounts[0]+"/", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/gmailAccounts/?next="+url.QueryEscape(prefix), http.StatusSeeOther)
+	}
+}
+
+func webGmailAccounts(w http.ResponseWriter, r *http.Request) error {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/gmail") {
+		next = "/gmailFetch/"
+	}
+
+	return renderPage(w, "gmail-accounts.html", "Gmail accounts", "", struct {
+		Accounts []string
+		Next     string
+	}{listGmailAccounts(), next})
+}
+
+const (
+	loginStateCookie = "gmail_login_state"
+	loginTimeout     = 10 * time.Minute
+)
+
+// pendingLogin is an authorization request that was sent to Google and waits
+// for the redirect back to /oauth2callback.
+type pendingLogin struct {
+	verifier    string
+	redirectURL string
+	created     time.Time
+}
+
+// pendingLogins maps the random state of each login to its PKCE verifier.
+var pendingLogins = struct {
+	sync.Mutex
+	logins map[string]pendingLogin
+}{logins: map[string]pendingLogin{}}
+
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// loopbackRedirectURL returns the callback URL on this server as the browser
+// reached it, so the state cookie is sent back. Google only redirects to
+// loopback addresses for installed apps.
+func loopbackRedirectURL(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	switch host {
+	case "localhost", "127.0.0.1", "::1":
+		return "http://" + r.Host + "/oauth2callback"
+	}
+	return "http://localhost:8080/oauth2callback"
+}
+
+// webGmailLogin sends the browser to Google to authorize another Gmail
+// account. Google redirects back to webOAuth2Callback.
+func webGmailLogin(w http.ResponseWriter, r *http.Request) error {
+	config, err := gmailConfig()
+	if err != nil {
+		return newWebError(http.StatusInternalServerError, "Unable to read client secret file", err)
+	}
+
+	state, err := randomState()
+	if err != nil {
+		return newWebError(http.StatusInternalServerError, "Unable to create login state", err)
+	}
+	login := pendingLogin{
+		verifier:    oauth2.GenerateVerifier(),
+		redirectURL: loopbackRedirectURL(r),
+		created:     time.Now(),
+	}
+
+	pendingLogins.Lock()
+	for s, l := range pendingLogins.logins {
+		if time.Since(l.created) > loginTimeout {
+			delete(pendingLogins.logins, s)
+		}
+	}
+	pendingLogins.logins[state] = login
+	pendingLogins.Unlock()
+
+	// the state is bound to this browser as well, so a callback URL
+	// crafted by someone else cannot log us into their account
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginStateCookie,
+		Value:    state,
+		Path:     "/oauth2callback",
+		MaxAge:   int(loginTimeout / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// always ask for the account and consent, otherwise Google signs in the
+	// last account again and hands out no refresh token
+	config.RedirectURL = login.redirectURL
+	opts := []oauth2.AuthCodeOption{
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("prompt", "select_account consent"),
+		oauth2.S256ChallengeOption(login.verifier),
+	}
+	if hint := r.FormValue("account"); len(hint) > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", hint))
+	}
+	http.Redirect(w, r, config.AuthCodeURL(state, opts...), http.StatusFound)
+	return nil
+}
+
+// webOAuth2Callback finishes a login started by webGmailLogin. The token is
+// stored under the email address Gmail reports for it.
+func webOAuth2Callback(w http.ResponseWriter, r *http.Request) error {
+	state := r.FormValue("state")
+	cookie, err := r.Cookie(loginStateCookie)
+	if err != nil || len(state) == 0 || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return newWebError(http.StatusBadRequest, "Invalid login state, please log in again.", nil)
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginStateCookie, Path: "/oauth2callback", MaxAge: -1})
+
+	pendingLogins.Lock()
+	login, ok := pendingLogins.logins[state]
+	delete(pendingLogins.logins, state)
+	pendingLogins.Unlock()
+	if !ok || time.Since(login.created) > loginTimeout {
+		return newWebError(http.StatusBadRequest, "The login expired, please log in again.", nil)
+	}
+
+	if reason := r.FormValue("error"); len(reason) > 0 {
+		return newWebError(http.StatusForbidden, "Google did not grant access: "+reason, nil)
+	}
+
+	config, err := gmailConfig()
+	if err != nil {
+		return newWebError(http.StatusInternalServerError, "Unable to read client secret file", err)
+	}
+	config.RedirectURL = login.redirectURL
+
+	tok, err := config.Exchange(context.Background(), r.FormValue("code"), oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		return newWebError(http.StatusBadGateway, "Unable to retrieve token from web", err)
+	}
+
+	account, err := gmailAccountOf(config.Client(context.Background(), tok))
+	if err != nil {
+		return gmailError("Unable to retrieve the gmail address", err)
+	}
+
+	cacheFile, err := tokenCacheFile(account)
+	if err != nil {
+		return newWebError(http.StatusInternalServerError, "Unable to get path to cached credential file", err)
+	}
+	if err := saveToken(cacheFile, tok); err != nil {
+		return newWebError(http.StatusInternalServerError, "Unable to cache oauth token", err)
+	}
+	http.Redirect(w, r, "/gmailFetch/"+account+"/", http.StatusSeeOther)
+	return nil
+}
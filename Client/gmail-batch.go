@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const gmailBatchURL = "https://gmail.googleapis.com/batch/gmail/v1"
+
+// gmailService is the Gmail API client together with the authorized HTTP
+// client it was made from, which batch requests are sent with, and the
+// account it is authorized for, whose message cache it uses.
+type gmailService struct {
+	*gmail.Service
+	client  *http.Client
+	account string
+}
+
+// fetchedThread is a thread fetched by fetchThreads with the mails extracted
+// from it, or the error fetching it.
+type fetchedThread struct {
+	ID     string
+	Thread *gmail.Thread
+	Mails  []MailMessage
+	Cached bool
+	Err    error
+}
+
+// fetchThreads fetches the full threads and streams them in the order they
+// arrive, so the caller can classify the first threads while the rest are
+// still loading. Threads whose historyId is known and that did not change
+// since are read from the message cache, the others are fetched by
+// -gmail-fetch-workers requests at the same time, each a Gmail batch request
+// of up to -gmail-batch-size threads.
+// The channel is closed when all threads are sent, or when ctx is done.
+func fetchThreads(ctx context.Context, srv *gmailService, threads []*gmail.Thread) <-chan fetchedThread {
+	out := make(chan fetchedThread)
+	size := *gmailBatchSize
+	if size < 1 {
+		size = 1
+	}
+	batches := make(chan []string)
+
+	var wg sync.WaitGroup
+	workers := *gmailFetchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				for _, fetched := range srv.getThreads(batch) {
+					if fetched.Err == nil {
+						fetched.Mails = threadMessages(fetched.Thread)
+						cacheThread(srv.account, fetched.Thread, fetched.Mails)
+					}
+					select {
+					case out <- fetched:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(out)
+		defer wg.Wait()
+		defer close(batches)
+
+		ids := []string{}
+		for _, thread := range threads {
+			cached, mails, ok := cachedThreadAt(srv.account, thread.Id, thread.HistoryId)
+			if !ok {
+				ids = append(ids, thread.Id)
+				continue
+			}
+			select {
+			case out <- fetchedThread{ID: thread.Id, Thread: cached, Mails: mails, Cached: true}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for start := 0; start < len(ids); start += size {
+			end := start + size
+			if end > len(ids) {
+				end = len(ids)
+			}
+			select {
+			case batches <- ids[start:end]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// getThreads fetches threads with one batch request. Threads the batch could
+// not get because of a rate limit or server error or whose answer was
+// broken, or all of them if the batch request itself failed, are fetched one
+// by one with retries.
+func (srv *gmailService) getThreads(ids []string) []fetchedThread {
+	if len(ids) == 1 {
+		return []fetchedThread{srv.getThread(ids[0])}
+	}
+
+	fetched, err := srv.batchGetThreads(ids)
+	if err != nil {
+		log.Printf("Gmail batch request failed, fetching %d threads one by one: %v", len(ids), err)
+		fetched = make([]fetchedThread, len(ids))
+		for i, id := range ids {
+			fetched[i] = fetchedThread{ID: id, Err: err}
+		}
+	}
+	for i, f := range fetched {
+		if f.Err == nil {
+			continue
+		}
+		var apiErr *googleapi.Error
+		if retry, _ := retryableGmailError(f.Err); retry || err != nil || !errors.As(f.Err, &apiErr) {
+			fetched[i] = srv.getThread(f.ID)
+		}
+	}
+	return fetched
+}
+
+// getThread fetches a single thread.
+func (srv *gmailService) getThread(id string) fetchedThread {
+	var thread *gmail.Thread
+	err := gmailDo(gmailThreadsGet, func() (err error) {
+		thread, err = srv.Users.Threads.Get("me", id).Do()
+		return err
+	})
+	return fetchedThread{ID: id, Thread: thread, Err: err}
+}
+
+// batchURL is the batch endpoint, next to the API at -gmail-endpoint if one
+// is set.
+func batchURL() string {
+	if *gmailEndpoint != "" {
+		return strings.TrimSuffix(*gmailEndpoint, "/") + "/batch/gmail/v1"
+	}
+	return gmailBatchURL
+}
+
+// batchGetThreads sends one batch request with a threads.get call for every
+// ID, see https://developers.google.com/gmail/api/guides/batch. The error is
+// only set if the batch as a whole failed, errors of single calls are in the
+// results.
+func (srv *gmailService) batchGetThreads(ids []string) ([]fetchedThread, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, id := range ids {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {"<item-" + strconv.Itoa(i) + ">"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(part, "GET /gmail/v1/users/me/threads/%s?format=full\r\n\r\n", url.PathEscape(id))
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	// every call of the batch counts against the quota
+	waited := gmailRate.waitAll(gmailThreadsGet.Units, len(ids))
+	recordGmailUsage(gmailThreadsGet, func(m *methodUsage) {
+		m.Calls += len(ids)
+		m.Units += len(ids) * gmailThreadsGet.Units
+	}, waited, 0)
+
+	resp, err := srv.client.Post(batchURL(), "multipart/mixed; boundary="+mw.Boundary(), &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("unexpected batch response %q", resp.Header.Get("Content-Type"))
+	}
+
+	fetched := make([]fetchedThread, len(ids))
+	for i, id := range ids {
+		fetched[i] = fetchedThread{ID: id, Err: fmt.Errorf("thread %s missing in the batch response", id)}
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for n := 0; ; n++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				return fetched, nil
+			}
+			return nil, err
+		}
+
+		// answers are marked "<response-item-N>", fall back to their order
+		i := n
+		if cid := strings.Trim(part.Header.Get("Content-Id"), "<>"); strings.HasPrefix(cid, "response-item-") {
+			if index, err := strconv.Atoi(strings.TrimPrefix(cid, "response-item-")); err == nil {
+				i = index
+			}
+		}
+		if i < 0 || i >= len(ids) {
+			continue
+		}
+		fetched[i].Thread, fetched[i].Err = readBatchThread(part)
+	}
+}
+
+// readBatchThread reads the HTTP response to a threads.get call of a batch.
+func readBatchThread(part *multipart.Part) (*gmail.Thread, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	thread := &gmail.Thread{}
+	if err := json.Unmarshal(b, thread); err != nil {
+		return nil, err
+	}
+	return thread, nil
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	classifyJobFile     = "classify-job"
+	classifyResultsFile = "classify-results"
+	classifyJobPageSize = 100
+)
+
+// ClassifyJobState is the progress of the bulk classification job. It is
+// written to disk after every page so an interrupted job can resume from
+// PageToken after a restart.
+//
+// HistoryID is the mailbox history ID the results are up to date with. It is
+// set once a full pass finished and advanced by every incremental sync.
+// RetryThreadIDs are the threads that could not be fetched or classified
+// since, the next sync tries them again.
+type ClassifyJobState struct {
+	PageToken      string
+	PassHistoryID  uint64
+	HistoryID      uint64
+	RetryThreadIDs []string
+	WriteLabels    bool
+	DryRun         bool
+	Pages          int
+	Processed      int
+	Failed         int
+	Finished       bool
+	Syncing        bool
+	LastError      string
+	Started        time.Time
+	Updated        time.Time
+	LastSync       time.Time
+}
+
+// ClassifiedThread is the stored classification of a single thread.
+// HistoryID is the thread's history ID when it was classified, it changes
+// when messages are added.
+type ClassifiedThread struct {
+	ID        string
+	HistoryID uint64
+	Snippet   string
+	Results   []ClassificationResult
+	Label     *LabelChange
+}
+
+type classifyJob struct {
+	sync.Mutex
+	account  string
+	running  bool
+	stopping bool
+	state    ClassifyJobState
+	results  map[string]ClassifiedThread
+}
+
+// classifyJobs holds the bulk job of every Gmail account.
+var classifyJobs = struct {
+	sync.Mutex
+	jobs map[string]*classifyJob
+}{jobs: map[string]*classifyJob{}}
+
+// classifyJobFor returns the bulk job of a Gmail account, restoring the state
+// of a previous run from disk on first use.
+func classifyJobFor(account string) *classifyJob {
+	classifyJobs.Lock()
+	defer classifyJobs.Unlock()
+
+	job, ok := classifyJobs.jobs[account]
+	if !ok {
+		job = &classifyJob{account: account, results: map[string]ClassifiedThread{}}
+		job.load()
+		classifyJobs.jobs[account] = job
+	}
+	return job
+}
+
+// load restores state and results of a previous run from disk.
+func (job *classifyJob) load() {
+	job.Lock()
+	defer job.Unlock()
+
+	if err := loadJSON(accountFile(classifyJobFile, job.account), &job.state); err != nil {
+		log.Printf("Unable to load classification job state: %v", err)
+	}
+	if err := loadJSON(accountFile(classifyResultsFile, job.account), &job.results); err != nil {
+		log.Printf("Unable to load classification results: %v", err)
+	}
+}
+
+// save writes state and results to disk, the caller must hold the lock.
+func (job *classifyJob) save() {
+	job.state.Updated = time.Now()
+	if err := saveJSON(accountFile(classifyResultsFile, job.account), job.results); err != nil {
+		log.Printf("Unable to save classification results: %v", err)
+	}
+	if err := saveJSON(accountFile(classifyJobFile, job.account), job.state); err != nil {
+		log.Printf("Unable to save classification job state: %v", err)
+	}
+}
+
+// start runs the job in the background. An unfinished previous run is
+// resumed from its last page token, a finished one is started over.
+// With writeLabels the top category of every thread is also written back to
+// Gmail, or only recorded if dryRun is set.
+func (job *classifyJob) start(srv *gmailService, writeLabels, dryRun bool) bool {
+	job.Lock()
+	defer job.Unlock()
+
+	if job.running {
+		return false
+	}
+	if job.state.Finished || job.state.Started.IsZero() {
+		// keep the history ID, new mail can still be synced until the
+		// new pass is done
+		job.state = ClassifyJobState{Started: time.Now(), HistoryID: job.state.HistoryID, LastSync: job.state.LastSync}
+		job.results = map[string]ClassifiedThread{}
+	}
+	job.state.WriteLabels = writeLabels
+	job.state.DryRun = dryRun
+	job.state.LastError = ""
+	job.running = true
+	job.stopping = false
+
+	go job.run(srv)
+	return true
+}
+
+// startSync classifies the threads that received new messages since the
+// stored history ID in the background. It needs a finished full pass first.
+func (job *classifyJob) startSync(srv *gmailService) bool {
+	job.Lock()
+	defer job.Unlock()
+
+	if job.running || job.state.HistoryID == 0 {
+		return false
+	}
+	job.state.LastError = ""
+	job.state.Syncing = true
+	job.running = true
+	job.stopping = false
+
+	go job.runSync(srv)
+	return true
+}
+
+func (job *classifyJob) stop() {
+	job.Lock()
+	defer job.Unlock()
+	job.stopping = true
+}
+
+func (job *classifyJob) shouldStop() bool {
+	job.Lock()
+	defer job.Unlock()
+	return job.stopping
+}
+
+// finish is deferred by the job goroutines, it turns a panic into an error
+// and persists the final state.
+func (job *classifyJob) finish() {
+	job.Lock()
+	defer job.Unlock()
+
+	if r := recover(); r != nil {
+		job.state.LastError = fmt.Sprint(r)
+		log.Printf("Classification job aborted: %v", r)
+	}
+	job.running = false
+	job.state.Syncing = false
+	job.save()
+	flushPriors()
+}
+
+func (job *classifyJob) fail(err error) {
+	job.Lock()
+	defer job.Unlock()
+
+	job.state.Failed++
+	job.state.LastError = err.Error()
+}
+
+// newLabeler returns the labeler for the configured label mode, or nil if
+// labels are not written.
+func (job *classifyJob) newLabeler(srv *gmailService) (*gmailLabeler, error) {
+	job.Lock()
+	state := job.state
+	job.Unlock()
+
+	if !state.WriteLabels {
+		return nil, nil
+	}
+	return newGmailLabeler(srv, state.DryRun)
+}
+
+func (job *classifyJob) run(srv *gmailService) {
+	defer job.finish()
+	defer startQuotaBatch("the classification job").log()
+
+	user := "me"
+	job.Lock()
+	pageToken := job.state.PageToken
+	passHistoryID := job.state.PassHistoryID
+	job.Unlock()
+
+	if passHistoryID == 0 {
+		// remember where the mailbox stands before the pass, everything
+		// arriving while it runs is picked up by the next sync
+		var profile *gmail.Profile
+		err := gmailDo(gmailGetProfile, func() (err error) {
+			profile, err = srv.Users.GetProfile(user).Do()
+			return err
+		})
+		if err != nil {
+			job.fail(err)
+			return
+		}
+		job.Lock()
+		job.state.PassHistoryID = profile.HistoryId
+		job.Unlock()
+	}
+
+	labeler, err := job.newLabeler(srv)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+
+	for {
+		var r *gmail.ListThreadsResponse
+		err := gmailDo(gmailThreadsList, func() (err error) {
+			r, err = srv.Users.Threads.List(user).LabelIds("INBOX").MaxResults(classifyJobPageSize).PageToken(pageToken).Do()
+			return err
+		})
+		if err != nil {
+			job.fail(err)
+			return
+		}
+
+		threads := []*gmail.Thread{}
+		job.Lock()
+		for _, thread := range r.Threads {
+			// skip the threads classified before an interruption of the
+			// current page
+			if _, done := job.results[thread.Id]; !done {
+				threads = append(threads, thread)
+			}
+		}
+		job.Unlock()
+		done, failed := job.classifyThreads(srv, labeler, threads)
+		if !done {
+			// the page token is not advanced, a resumed run classifies the
+			// rest of the page
+			return
+		}
+
+		job.Lock()
+		job.state.RetryThreadIDs = append(job.state.RetryThreadIDs, failed...)
+		pageToken = r.NextPageToken
+		job.state.PageToken = pageToken
+		job.state.Pages++
+		job.state.Finished = pageToken == ""
+		if job.state.Finished {
+			job.state.HistoryID = job.state.PassHistoryID
+		}
+		job.save()
+		job.Unlock()
+
+		if pageToken == "" {
+			return
+		}
+	}
+}
+
+func (job *classifyJob) runSync(srv *gmailService) {
+	defer job.finish()
+	defer startQuotaBatch("the classification sync").log()
+
+	user := "me"
+	job.Lock()
+	historyID := job.state.HistoryID
+	retry := job.state.RetryThreadIDs
+	job.Unlock()
+
+	labeler, err := job.newLabeler(srv)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+
+	// the history does not tell the threads' historyIds, they are always
+	// fetched
+	threads := []*gmail.Thread{}
+	seen := map[string]bool{}
+	for _, threadID := range retry {
+		seen[threadID] = true
+		threads = append(threads, &gmail.Thread{Id: threadID})
+	}
+	pageToken := ""
+	for {
+		var r *gmail.ListHistoryResponse
+		err := gmailDo(gmailHistoryList, func() (err error) {
+			r, err = srv.Users.History.List(user).StartHistoryId(historyID).HistoryTypes("messageAdded").LabelId("INBOX").PageToken(pageToken).Do()
+			return err
+		})
+		if err != nil {
+			if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+				// Gmail only keeps the history for a limited time, once
+				// the ID expired only a full pass brings us up to date
+				job.Lock()
+				job.state.HistoryID = 0
+				job.Unlock()
+			}
+			job.fail(err)
+			return
+		}
+
+		for _, history := range r.History {
+			for _, added := range history.MessagesAdded {
+				if threadID := added.Message.ThreadId; !seen[threadID] {
+					seen[threadID] = true
+					threads = append(threads, &gmail.Thread{Id: threadID})
+				}
+			}
+		}
+
+		pageToken = r.NextPageToken
+		if pageToken == "" {
+			historyID = r.HistoryId
+			break
+		}
+	}
+
+	done, failed := job.classifyThreads(srv, labeler, threads)
+	if !done {
+		// the history ID is not advanced, the next sync starts over
+		return
+	}
+	if len(failed) > 0 {
+		log.Printf("%d threads failed, they are tried again by the next sync", len(failed))
+	}
+
+	job.Lock()
+	job.state.HistoryID = historyID
+	job.state.RetryThreadIDs = failed
+	job.state.LastSync = time.Now()
+	job.Unlock()
+}
+
+// classifyThreads fetches and classifies the threads, each as soon as it
+// arrives. It returns false if the job was stopped before all were done, or
+// if the classification server is not running, which would fail every
+// thread after it as well. The IDs of the threads that failed are returned
+// too, except for threads that were deleted meanwhile.
+func (job *classifyJob) classifyThreads(srv *gmailService, labeler *gmailLabeler, threads []*gmail.Thread) (bool, []string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	failed := []string{}
+	for fetched := range fetchThreads(ctx, srv, threads) {
+		if job.shouldStop() {
+			return false, failed
+		}
+		if fetched.Err != nil {
+			job.fail(fetched.Err)
+			if !threadDeleted(fetched.Err) {
+				failed = append(failed, fetched.ID)
+			}
+			continue
+		}
+		if err := job.classifyThread(labeler, fetched.Thread, fetched.Mails); err != nil {
+			job.fail(err)
+			failed = append(failed, fetched.ID)
+			if classifierUnavailable(err) {
+				log.Printf("Classification job stopped: %v", err)
+				return false, failed
+			}
+		}
+	}
+	return !job.shouldStop(), failed
+}
+
+// threadDeleted reports whether fetching a thread failed because it does not
+// exist anymore, trying it again is pointless then.
+func threadDeleted(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+func (job *classifyJob) classifyThread(labeler *gmailLabeler, thread *gmail.Thread, mails []MailMessage) error {
+	threadID := thread.Id
+	results, err := classifyMails(mails)
+	if err != nil {
+		return err
+	}
+	classified := ClassifiedThread{ID: threadID, HistoryID: thread.HistoryId, Results: results}
+	if len(mails) > 0 {
+		classified.Snippet = mails[0].Short
+	}
+
+	if labeler != nil {
+		change, err := labeler.apply(thread, classified.Results)
+		if err != nil {
+			return err
+		}
+		classified.Label = &change
+	}
+
+	job.Lock()
+	job.results[threadID] = classified
+	job.state.Processed++
+	job.Unlock()
+	return nil
+}
+
+// result returns the stored classification of a thread.
+func (job *classifyJob) result(threadID string) (ClassifiedThread, bool) {
+	job.Lock()
+	defer job.Unlock()
+	classified, ok := job.results[threadID]
+	return classified, ok
+}
+
+// classifyJobStatus is a snapshot of the job for the status page.
+type classifyJobStatus struct {
+	Account   string
+	Running   bool
+	Stopping  bool
+	CanWrite  bool
+	LabelRoot string
+	State     ClassifyJobState
+	Results   []ClassifiedThread
+}
+
+func (job *classifyJob) status() classifyJobStatus {
+	job.Lock()
+	defer job.Unlock()
+
+	status := classifyJobStatus{Account: job.account, Running: job.running, Stopping: job.stopping, CanWrite: *writeLabels, LabelRoot: classifierLabelRoot, State: job.state}
+	for _, classified := range job.results {
+		status.Results = append(status.Results, classified)
+	}
+	sort.Slice(status.Results, func(i, j int) bool { return status.Results[i].ID < status.Results[j].ID })
+	return status
+}
+
+func webGmailClassifyAll(w http.ResponseWriter, r *http.Request) error {
+	account, subPage := splitAccountPath(r.URL.Path, "/gmailClassifyAll/")
+	subPage = strings.Trim(subPage, "/")
+	if len(account) == 0 {
+		redirectToAccount(w, r, "/gmailClassifyAll/")
+		return nil
+	}
+	job := classifyJobFor(account)
+	statusPage := "/gmailClassifyAll/" + account + "/"
+
+	if subPage == "start" {
+		srv, err := webGmailService(w, r, account)
+		if err != nil || srv == nil {
+			return err
+		}
+
+		label := len(r.FormValue("writeLabels")) > 0
+		dryRun := len(r.FormValue("dryRun")) > 0 || !*writeLabels
+		job.start(srv, label, dryRun)
+		http.Redirect(w, r, statusPage, http.StatusSeeOther)
+		return nil
+	} else if subPage == "sync" {
+		srv, err := webGmailService(w, r, account)
+		if err != nil || srv == nil {
+			return err
+		}
+
+		job.startSync(srv)
+		http.Redirect(w, r, statusPage, http.StatusSeeOther)
+		return nil
+	} else if subPage == "stop" {
+		job.stop()
+		http.Redirect(w, r, statusPage, http.StatusSeeOther)
+		return nil
+	}
+
+	return renderPage(w, "gmail-classify-all.html", "Classify whole inbox", account, job.status())
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// fakeGmail is a local Gmail API server with the parts of the API the client
+// uses: labels, threads and batch requests of threads.get.
+type fakeGmail struct {
+	sync.Mutex
+	labels   []*gmail.Label
+	threads  map[string]*gmail.Thread
+	modified map[string][]*gmail.ModifyThreadRequest // by thread ID
+	created  []string                                // names of created labels
+	requests []string                                // method and path of every call
+	batches  int
+}
+
+func newFakeGmail() *fakeGmail {
+	return &fakeGmail{threads: map[string]*gmail.Thread{}, modified: map[string][]*gmail.ModifyThreadRequest{}}
+}
+
+// start serves f on a local port and points -gmail-endpoint at it for the
+// rest of the test. It returns a Gmail service using the fake.
+func (f *fakeGmail) start(t *testing.T) *gmailService {
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+
+	endpoint := *gmailEndpoint
+	*gmailEndpoint = ts.URL
+	t.Cleanup(func() { *gmailEndpoint = endpoint })
+
+	srv, err := newGmailService(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func (f *fakeGmail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/batch/gmail/v1" {
+		f.serveBatch(w, r)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	path := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/me/")
+	switch {
+	case path == "labels" && r.Method == "GET":
+		writeFakeJSON(w, &gmail.ListLabelsResponse{Labels: f.labels})
+	case path == "labels" && r.Method == "POST":
+		label := &gmail.Label{}
+		if err := json.NewDecoder(r.Body).Decode(label); err != nil {
+			writeFakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, existing := range f.labels {
+			if existing.Name == label.Name {
+				writeFakeError(w, http.StatusConflict, "Label name exists or conflicts")
+				return
+			}
+		}
+		label.Id = "Label_" + strconv.Itoa(len(f.labels)+1)
+		label.Type = "user"
+		f.labels = append(f.labels, label)
+		f.created = append(f.created, label.Name)
+		writeFakeJSON(w, label)
+	case strings.HasPrefix(path, "threads/") && strings.HasSuffix(path, "/modify") && r.Method == "POST":
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "threads/"), "/modify")
+		thread, ok := f.threads[id]
+		if !ok {
+			writeFakeError(w, http.StatusNotFound, "Requested entity was not found.")
+			return
+		}
+		req := &gmail.ModifyThreadRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeFakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.modified[id] = append(f.modified[id], req)
+		writeFakeJSON(w, thread)
+	case strings.HasPrefix(path, "threads/") && r.Method == "GET":
+		thread, ok := f.threads[strings.TrimPrefix(path, "threads/")]
+		if !ok {
+			writeFakeError(w, http.StatusNotFound, "Requested entity was not found.")
+			return
+		}
+		writeFakeJSON(w, thread)
+	default:
+		writeFakeError(w, http.StatusNotFound, "Not found: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// serveBatch answers every part of a batch request like the single call,
+// see https://developers.google.com/gmail/api/guides/batch
+func (f *fakeGmail) serveBatch(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	f.batches++
+	f.Unlock()
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			continue
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+
+		cid := strings.Trim(part.Header.Get("Content-Id"), "<>")
+		out, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {"<response-" + cid + ">"},
+		})
+		if err != nil {
+			return
+		}
+		rec.Result().Write(out)
+	}
+	mw.Close()
+}
+
+func writeFakeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeFakeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, message)
+}
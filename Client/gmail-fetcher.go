@@ -5,9 +5,11 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"os/user"
@@ -15,9 +17,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"text/template"
+	"time"
 
-	"github.com/pkg/browser"
 	"golang.org/x/net/context"
 	"golang.org/x/net/html"
 	"golang.org/x/oauth2"
@@ -25,193 +26,287 @@ import (
 	"google.golang.org/api/gmail/v1"
 )
 
-// getClient uses a Context and Config to retrieve a Token
-// then generate a Client. It returns the generated Client.
-func webGmailGetClient(w http.ResponseWriter, r *http.Request, page string) *http.Client {
+// webGmailGetClient returns a client authorized for the given Gmail account.
+// If there is no token for the account yet, the user is sent to the login
+// page and a nil client without error is returned.
+func webGmailGetClient(w http.ResponseWriter, r *http.Request, account string) (*http.Client, error) {
 	ctx := context.Background()
 
-	b, err := ioutil.ReadFile("client_id.json")
+	config, err := gmailConfig()
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
-		return nil
+		return nil, newWebError(http.StatusInternalServerError, "Unable to read client secret file", err)
 	}
 
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	cacheFile, err := tokenCacheFile(account)
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
-		return nil
+		return nil, newWebError(http.StatusInternalServerError, "Unable to get path to cached credential file", err)
+	}
+	tok, err := tokenFromFile(cacheFile)
+	if os.IsNotExist(err) || len(account) == 0 {
+		// no local token -> prompt for gmail-login and return
+		http.Redirect(w, r, "/gmailLogin/?account="+url.QueryEscape(account), http.StatusSeeOther)
+		return nil, nil
+	}
+	if err != nil {
+		// e.g. encrypted with another passphrase, logging in again would
+		// overwrite it
+		return nil, newWebError(http.StatusInternalServerError, "Unable to read the stored token of "+account, err)
 	}
 
-	cacheFile, err := tokenCacheFile()
+	client := oauth2.NewClient(ctx, newSavingTokenSource(ctx, config, cacheFile, tok))
+	return client, nil
+}
+
+// webGmailService returns the Gmail service for account, see
+// webGmailGetClient.
+func webGmailService(w http.ResponseWriter, r *http.Request, account string) (*gmailService, error) {
+	client, err := webGmailGetClient(w, r, account)
+	if err != nil || client == nil {
+		return nil, err
+	}
+	srv, err := newGmailService(client)
 	if err != nil {
-		log.Fatalf("Unable to get path to cached credential file. %v", err)
-		return nil
+		return nil, newWebError(http.StatusInternalServerError, "Unable to retrieve gmail Client", err)
 	}
-	tok, err := tokenFromFile(cacheFile)
+	srv.account = account
+	return srv, nil
+}
+
+// savingTokenSource writes every token it gets from the refresh token back to
+// the cache file, so the next start does not refresh again and a refresh
+// token rotated by Google is not lost.
+type savingTokenSource struct {
+	src  oauth2.TokenSource
+	file string
+	last string // access token last written to file
+}
+
+// newSavingTokenSource returns a token source for tok that refreshes with
+// config and persists new tokens to file.
+func newSavingTokenSource(ctx context.Context, config *oauth2.Config, file string, tok *oauth2.Token) oauth2.TokenSource {
+	// the config's source refreshes on every call, ReuseTokenSource only
+	// calls it when the token expired and serializes the calls
+	return oauth2.ReuseTokenSource(tok, &savingTokenSource{
+		src:  config.TokenSource(ctx, tok),
+		file: file,
+		last: tok.AccessToken,
+	})
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
 	if err != nil {
-		authCode := r.FormValue("token")
-
-		if len(authCode) > 0 {
-			tok, err = config.Exchange(oauth2.NoContext, authCode)
-			if err != nil {
-				log.Fatalf("Unable to retrieve token from web %v", err)
-				return nil
-			}
+		return nil, err
+	}
+	if tok.AccessToken != s.last {
+		if err := writeToken(s.file, tok); err != nil {
+			// the token still works for now, it is refreshed again next time
+			log.Printf("Unable to save the refreshed token to %s: %v", s.file, err)
 		} else {
-			// no local token -> prompt for gmail-login and return
-			htmlBody := `<h1>Login to Gmail</h1>
-        <p>Please click <a href="{{index . 0}}">here</a> and enter your authorization code:
-        <p><form action="/{{index . 1}}/" method="POST">
-          <div><input type="text" name="token"></div>
-          <div><input type="submit" value="Continue"></div>
-        </form></p>`
-
-			authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-			browser.OpenURL(authURL)
-
-			t, _ := template.New("gmail-auth").Parse(htmlBody)
-			t.Execute(w, []string{authURL, page})
-			return nil
+			s.last = tok.AccessToken
 		}
 	}
-
-	saveToken(cacheFile, tok)
-	client := config.Client(ctx, tok)
-	return client
+	return tok, nil
 }
 
-// getTokenFromWeb uses Config to request a Token.
-// It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
-	browser.OpenURL(authURL)
+// gmailConfig reads the OAuth client configuration from client_id.json.
+func gmailConfig() (*oauth2.Config, error) {
+	b, err := ioutil.ReadFile("client_id.json")
+	if err != nil {
+		return nil, err
+	}
+	return google.ConfigFromJSON(b, gmailScope())
+}
 
-	var code string
-	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+// gmailScope returns the OAuth scope to request. Read access is enough
+// unless writing labels back to Gmail was enabled.
+func gmailScope() string {
+	if *writeLabels {
+		return gmail.GmailModifyScope
 	}
+	return gmail.GmailReadonlyScope
+}
 
-	tok, err := config.Exchange(oauth2.NoContext, code)
+// tokenCacheDir returns the directory holding one credential file per
+// account. Tokens with modify access are kept apart from read-only ones.
+func tokenCacheDir() (string, error) {
+	usr, err := user.Current()
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		return "", err
 	}
-	return tok
+	name := "gmail-fetcher"
+	if gmailScope() == gmail.GmailModifyScope {
+		name = "gmail-fetcher-modify"
+	}
+	tokenCacheDir := filepath.Join(usr.HomeDir, ".credentials", name)
+	os.MkdirAll(tokenCacheDir, 0700)
+	return tokenCacheDir, nil
 }
 
-// tokenCacheFile generates credential file path/filename.
+// tokenCacheFile generates credential file path/filename for an account.
 // It returns the generated credential path/filename.
-func tokenCacheFile() (string, error) {
-	usr, err := user.Current()
+func tokenCacheFile(account string) (string, error) {
+	tokenCacheDir, err := tokenCacheDir()
 	if err != nil {
 		return "", err
 	}
-	tokenCacheDir := filepath.Join(usr.HomeDir, ".credentials")
-	os.MkdirAll(tokenCacheDir, 0700)
 	return filepath.Join(tokenCacheDir,
-		url.QueryEscape("gmail-fetcher.json")), err
+		url.QueryEscape(account)+".json"), err
+}
+
+// newGmailService creates the Gmail API client, pointed at -gmail-endpoint
+// instead of Google if that was given (e.g. a local fake server).
+func newGmailService(client *http.Client) (*gmailService, error) {
+	srv, err := gmail.New(client)
+	if err != nil {
+		return nil, err
+	}
+	if *gmailEndpoint != "" {
+		srv.BasePath = strings.TrimSuffix(*gmailEndpoint, "/") + "/"
+	}
+	return &gmailService{Service: srv, client: client}, nil
 }
 
-// tokenFromFile retrieves a Token from a given file path.
+// tokenFromFile retrieves a Token from a given file path, decrypting it with
+// tokenCacheKey if it is encrypted. A plain text token is encrypted in place
+// once a key is configured.
 // It returns the retrieved Token and any read error encountered.
 func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+	t, encrypted, err := readTokenFile(file)
 	if err != nil {
 		return nil, err
 	}
+	if !encrypted && len(tokenCacheKey) > 0 {
+		if err := writeToken(file, t); err != nil {
+			log.Printf("Unable to encrypt %s: %v", file, err)
+		}
+	}
+	return t, nil
+}
+
+// readTokenFile reads the token in file without changing it, decrypting it
+// with tokenCacheKey if it is encrypted. It also returns whether it was.
+func readTokenFile(file string) (*oauth2.Token, bool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false, err
+	}
+	encrypted := isEncryptedToken(b)
+	if encrypted {
+		if b, err = tokenCacheKey.open(b); err != nil {
+			return nil, true, err
+		}
+	}
 	t := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(t)
-	defer f.Close()
-	return t, err
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, encrypted, err
+	}
+	return t, encrypted, nil
 }
 
 // saveToken uses a file path to create a file and store the
-// token in it.
-func saveToken(file string, token *oauth2.Token) {
+// token in it, encrypted if a passphrase or key file is configured.
+func saveToken(file string, token *oauth2.Token) error {
 	fmt.Printf("Saving credential file to: %s\n", file)
-	f, err := os.Create(file)
+	return writeToken(file, token)
+}
+
+// writeToken replaces the token in file atomically.
+func writeToken(file string, token *oauth2.Token) error {
+	b, err := encodeToken(token, tokenCacheKey)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return err
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	return writeFileAtomic(file, b)
 }
 
-func webGmailFetch(w http.ResponseWriter, r *http.Request) {
-	client := webGmailGetClient(w, r, "gmailFetch")
-
-	if client == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+func webGmailFetch(w http.ResponseWriter, r *http.Request) error {
+	account, pageToken := splitAccountPath(r.URL.Path, "/gmailFetch/")
+	if len(account) == 0 {
+		redirectToAccount(w, r, "/gmailFetch/")
+		return nil
 	}
 
-	srv, err := gmail.New(client)
-	if err != nil {
-		log.Fatalf("Unable to retrieve gmail Client %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	srv, err := webGmailService(w, r, account)
+	if err != nil || srv == nil {
+		return err
 	}
 
-	webGmailListMails(w, r, srv)
+	query := threadQueryFrom(r)
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 0 || page > maxListPage || len(pageToken) == 0 {
+		page = 0
+	}
+	return webGmailListMails(w, srv, account, pageToken, query, page, pageStackFor(w, r, account, query))
 }
 
-func webGmailListMails(w http.ResponseWriter, req *http.Request, srv *gmail.Service) {
-	user := "me"
+// maxListPage limits the page number taken from links.
+const maxListPage = 10000
 
-	pageToken := ""
-	if len(req.URL.Path) > len("/gmailFetch/") {
-		pageToken = req.URL.Path[len("/gmailFetch/"):]
+func webGmailListMails(w http.ResponseWriter, srv *gmailService, account, pageToken string, query threadQuery, page int, stack pageStack) error {
+	r, err := listThreads(srv, query, pageToken)
+	if err != nil {
+		return gmailError("Unable to retrieve threads", err)
 	}
+	prevToken, hasPrev := stack.visit(page, pageToken, r.NextPageToken)
 
-	r, err := srv.Users.Threads.List(user).LabelIds("INBOX").MaxResults(30).PageToken(pageToken).Do()
+	labels, err := listLabels(srv)
 	if err != nil {
-		log.Fatalf("Unable to retrieve threads. %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return gmailError("Unable to retrieve labels", err)
 	}
 
-	htmlBody := `<h1>Gmail threads</h1>
-    <ul>
-      {{range .Threads}}
-      <li><a href="/gmailView/{{.Id}}">{{.Id}}</a>: {{.Snippet}}</li>
-      {{end}}
-    </ul>
-    <p><h2><a href="/gmailFetch/{{.NextPageToken}}">Next Page</a></h2></p>`
-
-	t, _ := template.New("gmail-threads").Parse(htmlBody)
-	t.Execute(w, r)
-}
-
-func webGmailView(w http.ResponseWriter, r *http.Request) {
-	client := webGmailGetClient(w, r, "gmailView")
-
-	threadID := r.URL.Path[len("/gmailView/"):]
-
-	srv, err := gmail.New(client)
+	// a classifier error is shown above the list, the threads are listed
+	// without category
+	classifyError := ""
+	threads, err := classifyListedThreads(srv, account, r.Threads)
 	if err != nil {
-		log.Fatalf("Unable to retrieve gmail Client %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Printf("Unable to classify threads: %v", err)
+		classifyError = err.Error()
 	}
-
-	webGmailViewThread(w, srv, threadID)
+	categories := countCategories(threads)
+
+	return renderPage(w, "gmail-threads.html", "Gmail threads", account, struct {
+		*gmail.ListThreadsResponse
+		Account       string
+		PageToken     string
+		Page          int
+		PageNumber    int
+		Pages         int64
+		PrevToken     string
+		HasPrev       bool
+		PrevPage      int
+		NextPage      int
+		Query         threadQuery
+		Labels        []*gmail.Label
+		Sizes         []int64
+		ClassifyError string
+		Categories    []CategoryCount
+		Groups        []CategoryGroup
+	}{r, account, pageToken, page, page + 1, pageCount(r.ResultSizeEstimate, query.Size),
+		prevToken, hasPrev, page - 1, page + 1, query, labels, pageSizes(query.Size), classifyError,
+		categories, groupThreads(threads, categories, query.Category, query.Group)})
 }
 
-func stripTags(in string) string {
-	out := ""
+func webGmailView(w http.ResponseWriter, r *http.Request) error {
+	account, threadID := splitAccountPath(r.URL.Path, "/gmailView/")
+	if len(account) == 0 {
+		redirectToAccount(w, r, "/gmailFetch/")
+		return nil
+	}
 
-	z := html.NewTokenizer(bytes.NewBufferString(in))
+	srv, err := webGmailService(w, r, account)
+	if err != nil || srv == nil {
+		return err
+	}
 
-	for {
-		tt := z.Next()
-		if tt == html.ErrorToken {
-			return out
-		} else if tt == html.TextToken {
-			out += " "
-			out += z.Token().Data
-		}
+	opts, err := classifyOptionsFrom(r)
+	if err != nil {
+		return err
 	}
+	// the list links the historyId it got, an unchanged thread is then
+	// read from the cache without asking Gmail
+	historyID, _ := strconv.ParseUint(r.FormValue("history"), 10, 64)
+	return webGmailViewThread(w, srv, account, threadID, historyID, len(r.FormValue("plain")) > 0, opts)
 }
 
 type MailMessage struct {
@@ -219,17 +314,25 @@ type MailMessage struct {
 	Subject string
 	ID      string
 	Short   string
+	From    string
+	To      string
+	Date    string
+	HTML    string // the text/html part, if any, unsanitized
+
+	// header signals, see header-signals.go
+	MessageID string
+	ListID    string
+	Bulk      bool
+	Labels    []string // Gmail label IDs
 }
 
-func base64dec(in string) string {
-	// messages from gmail are not base64 per se, they are a set of base64 strings separated by "-"
-	ret := ""
-	parts := strings.Split(in, "-")
-	for _, part := range parts {
-		out, _ := base64.StdEncoding.DecodeString(part)
-		ret += string(out)
-	}
-	return ret
+// decodeBase64URL decodes body data from the Gmail API, which is URL-safe
+// base64 with or without padding.
+func decodeBase64URL(in string) ([]byte, error) {
+	in = strings.TrimRight(strings.TrimSpace(in), "=")
+	// tolerate the standard alphabet and line breaks as well
+	in = strings.NewReplacer("+", "-", "/", "_", "\r", "", "\n", "").Replace(in)
+	return base64.RawURLEncoding.DecodeString(in)
 }
 
 type ClassificationResult struct {
@@ -237,102 +340,162 @@ type ClassificationResult struct {
 	Score    float64
 }
 
-type ByScore []interface{}
+// classifierURL is where the classification server answers, tests replace
+// it with a fake server.
+var classifierURL = "http://localhost:8099/classify"
 
-func (a ByScore) Len() int      { return len(a) }
-func (a ByScore) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByScore) Less(i, j int) bool {
-	return a[i].(map[string]interface{})["second"].(float64) > a[j].(map[string]interface{})["second"].(float64)
-}
-
-func getClassification(message string) []ClassificationResult {
-	r, err := http.Post("http://localhost:8099/classify", "text/plain", bytes.NewBufferString(message))
+// getClassification sends a text to the classification server and returns the
+// five most likely categories. The error is a webError with status 503 if the
+// server cannot be reached.
+func getClassification(message string) ([]ClassificationResult, error) {
+	r, err := http.Post(classifierURL, "text/plain", bytes.NewBufferString(message))
 	if err != nil {
-		panic(err)
+		return nil, newWebError(http.StatusServiceUnavailable, "The classification server is not running", err)
 	}
-	resp, _ := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	resp, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		panic(err)
+		return nil, newWebError(http.StatusBadGateway, "Unable to read the answer of the classification server", err)
 	}
-	var result []interface{}
-	json.Unmarshal(resp, &result)
-	fmt.Println("Received", len(result), "potential classes")
-
-	sort.Sort(ByScore(result))
-	ret := []ClassificationResult{}
-	for i := 0; i < 5 && i < len(result); i++ {
-		ret = append(ret, ClassificationResult{result[i].(map[string]interface{})["first"].(string), result[i].(map[string]interface{})["second"].(float64)})
+	if r.StatusCode != http.StatusOK {
+		return nil, newWebError(http.StatusBadGateway, "The classification server failed", fmt.Errorf("%s: %s", r.Status, resp))
 	}
-	return ret
-}
 
-func webGmailViewThread(w http.ResponseWriter, srv *gmail.Service, threadID string) {
-	user := "me"
-	r, err := srv.Users.Threads.Get(user, threadID).Do()
-	if err != nil {
-		log.Fatalf("Unable to retrieve thread. %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	var result []struct {
+		First  string  `json:"first"`
+		Second float64 `json:"second"`
 	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, newWebError(http.StatusBadGateway, "Unexpected answer from the classification server", err)
+	}
+	log.Println("Received", len(result), "potential classes")
 
-	funcMap := template.FuncMap{
-		"base64dec": base64dec,
+	sort.Slice(result, func(i, j int) bool { return result[i].Second > result[j].Second })
+	ret := []ClassificationResult{}
+	for i := 0; i < 5 && i < len(result); i++ {
+		ret = append(ret, ClassificationResult{result[i].First, result[i].Second})
 	}
+	return ret, nil
+}
 
+// threadMessages collects subject, snippet and the decoded body text of every
+// message in a thread.
+func threadMessages(thread *gmail.Thread) []MailMessage {
 	mails := []MailMessage{}
-	for _, message := range r.Messages {
-		msg := MailMessage{}
-
-		for _, header := range message.Payload.Headers {
-			if header.Name == "Subject" {
-				msg.Subject = header.Value
-				break
-			}
-		}
+	for _, message := range thread.Messages {
+		mails = append(mails, messageMail(message))
+	}
+	return mails
+}
 
-		msg.ID = message.Id
-		msg.Short = message.Snippet
-		if len(message.Payload.Parts) > 0 {
-			// message is multipart
-			for _, part := range message.Payload.Parts {
-				if part.MimeType == "text/plain" {
-					msg.Body += part.Body.Data
-				}
-			}
-			if len(msg.Body) == 0 {
-				msg.Body = message.Payload.Parts[0].Body.Data
-			}
-		} else {
-			msg.Body = message.Payload.Body.Data
+// messageMail extracts the headers and the text of a message.
+func messageMail(message *gmail.Message) MailMessage {
+	msg := MailMessage{}
+
+	var precedence, unsubscribe string
+	for _, header := range message.Payload.Headers {
+		switch textproto.CanonicalMIMEHeaderKey(header.Name) {
+		case "Subject":
+			msg.Subject = header.Value
+		case "From":
+			msg.From = header.Value
+		case "To":
+			msg.To = header.Value
+		case "Date":
+			msg.Date = mailHeaderDate(header.Value)
+		case "Message-Id":
+			msg.MessageID = header.Value
+		case "List-Id":
+			msg.ListID = listID(header.Value)
+		case "List-Unsubscribe":
+			unsubscribe = header.Value
+		case "Precedence":
+			precedence = header.Value
 		}
-		mails = append(mails, msg)
 	}
+	msg.Bulk = isBulkMail(precedence, unsubscribe)
+	msg.Labels = message.LabelIds
 
-	htmlBody := `<h1>Messages</h1>
-      <ul>
-        {{range .}}
-        <li>{{.Subject}}: {{.Short}}</li>
-        {{end}}
-      </ul>`
+	msg.ID = message.Id
+	msg.Short = html.UnescapeString(message.Snippet)
+	msg.Body, msg.HTML = messageText(message)
+	return msg
+}
 
+// threadText combines the bodies of all messages into the text that is sent
+// to the classifier, without quoted replies, signatures and disclaimers.
+func threadText(mails []MailMessage) string {
 	combinedMessages := ""
 	for _, msg := range mails {
-		if len(msg.Body) > 0 {
-			combinedMessages += " " + base64dec(msg.Body)
+		if body := cleanMailText(msg.Body); len(body) > 0 {
+			combinedMessages += " " + body
 		}
 	}
 
 	// fallback
-	if len(combinedMessages) == 0 {
+	if len(combinedMessages) == 0 && len(mails) > 0 {
 		combinedMessages = mails[0].Short
 	}
-	classifyResult := getClassification(combinedMessages)
+	return combinedMessages
+}
+
+// viewedMail is a message of the thread view, SafeHTML is its sanitized HTML
+// part unless plain text was asked for. Results are its own scores in the
+// message mode.
+type viewedMail struct {
+	MailMessage
+	SafeHTML template.HTML
+	Results  []ClassificationResult
+}
+
+func webGmailViewThread(w http.ResponseWriter, srv *gmailService, account, threadID string, historyID uint64, plain bool, opts classifyOptions) error {
+	r, mails, offline, err := srv.thread(threadID, historyID)
+	if err != nil {
+		return gmailError("Unable to retrieve thread "+threadID, err)
+	}
+
+	classifyResult, perMessage, err := classifyMailsWith(mails, opts)
+	if err != nil {
+		return err
+	}
+	// the list shows the scores of the default options
+	if opts == defaultClassifyOptions() && offline.IsZero() {
+		cacheClassification(account, ClassifiedThread{ID: threadID, HistoryID: r.HistoryId, Results: classifyResult})
+	}
+
+	viewed := []viewedMail{}
+	for i, msg := range mails {
+		v := viewedMail{MailMessage: msg}
+		if perMessage != nil {
+			v.Results = perMessage[i]
+		}
+		if !plain && len(msg.HTML) > 0 {
+			// sanitized, so it is safe to insert without escaping
+			v.SafeHTML = template.HTML(sanitizeHTML(msg.HTML))
+		}
+		viewed = append(viewed, v)
+	}
+
+	return renderPage(w, "gmail-thread.html", threadTitle(mails), account, struct {
+		Account    string
+		ThreadID   string
+		HistoryID  uint64
+		Offline    time.Time
+		Plain      bool
+		Options    classifyOptions
+		Modes      []string
+		Strategies []string
+		Mails      []viewedMail
+		Results    []ClassificationResult
+		Signals    []string
+		Texts      []classifierText
+	}{account, threadID, r.HistoryId, offline, plain, opts, classifyModes, combineStrategies, viewed, classifyResult, mailSignals(mails), classifierTexts(mails, opts)})
+}
 
-	htmlBody += `<p><h2>Classification Scores:</h2><ul>`
-	for _, c := range classifyResult {
-		htmlBody += "<li>" + c.Category + ": " + strconv.FormatFloat(c.Score, 'g', -1, 64) + "</li>"
+// threadTitle is the subject of the first message.
+func threadTitle(mails []MailMessage) string {
+	if len(mails) == 0 {
+		return "Thread"
 	}
-	htmlBody += `</ul></p>`
-	t, _ := template.New("gmail-thead").Funcs(funcMap).Parse(htmlBody)
-	t.Execute(w, mails)
+	return mails[0].Subject
 }
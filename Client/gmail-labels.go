@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// classifierLabelRoot is the parent of all labels written by the classifier,
+// a thread in category "Physics" gets the label "Classifier/Physics".
+const classifierLabelRoot = "Classifier"
+
+func categoryLabelName(category string) string {
+	return classifierLabelRoot + "/" + category
+}
+
+// LabelChange describes how the labels of a thread are (or would be) changed.
+type LabelChange struct {
+	ThreadID string
+	Add      string
+	Remove   []string
+	Applied  bool
+}
+
+// gmailLabeler writes the top classification result of threads back to Gmail.
+// In dry-run mode it only computes the changes, which works with read-only
+// access as well.
+type gmailLabeler struct {
+	sync.Mutex
+	srv    *gmailService
+	dryRun bool
+	ids    map[string]string // label name -> label ID
+	names  map[string]string // label ID -> label name
+}
+
+func newGmailLabeler(srv *gmailService, dryRun bool) (*gmailLabeler, error) {
+	var r *gmail.ListLabelsResponse
+	err := gmailDo(gmailLabelsList, func() (err error) {
+		r, err = srv.Users.Labels.List("me").Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &gmailLabeler{srv: srv, dryRun: dryRun, ids: map[string]string{}, names: map[string]string{}}
+	for _, label := range r.Labels {
+		l.ids[label.Name] = label.Id
+		l.names[label.Id] = label.Name
+	}
+	return l, nil
+}
+
+// labelID returns the ID of the label with the given name, creating the
+// label if it does not exist yet. The caller must hold the lock.
+func (l *gmailLabeler) labelID(name string) (string, error) {
+	if id, ok := l.ids[name]; ok {
+		return id, nil
+	}
+
+	log.Printf("Creating gmail label %s", name)
+	var label *gmail.Label
+	err := gmailDo(gmailLabelsCreate, func() (err error) {
+		label, err = l.srv.Users.Labels.Create("me", &gmail.Label{
+			Name:                  name,
+			LabelListVisibility:   "labelShow",
+			MessageListVisibility: "show",
+		}).Do()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create label %s: %v", name, err)
+	}
+
+	l.ids[label.Name] = label.Id
+	l.names[label.Id] = label.Name
+	return label.Id, nil
+}
+
+// apply labels the thread with the category of the top result and removes
+// classifier labels of other categories left over from earlier runs.
+func (l *gmailLabeler) apply(thread *gmail.Thread, results []ClassificationResult) (LabelChange, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	change := LabelChange{ThreadID: thread.Id}
+	if len(results) == 0 {
+		return change, nil
+	}
+
+	current := map[string]bool{}
+	for _, message := range thread.Messages {
+		for _, id := range message.LabelIds {
+			if name := l.names[id]; strings.HasPrefix(name, classifierLabelRoot+"/") {
+				current[name] = true
+			}
+		}
+	}
+
+	if name := categoryLabelName(results[0].Category); current[name] {
+		delete(current, name)
+	} else {
+		change.Add = name
+	}
+	for name := range current {
+		change.Remove = append(change.Remove, name)
+	}
+	sort.Strings(change.Remove)
+
+	if l.dryRun || (change.Add == "" && len(change.Remove) == 0) {
+		return change, nil
+	}
+
+	req := &gmail.ModifyThreadRequest{}
+	if change.Add != "" {
+		// create the parent first so Gmail shows the labels nested
+		if _, err := l.labelID(classifierLabelRoot); err != nil {
+			return change, err
+		}
+		id, err := l.labelID(change.Add)
+		if err != nil {
+			return change, err
+		}
+		req.AddLabelIds = append(req.AddLabelIds, id)
+	}
+	for _, name := range change.Remove {
+		req.RemoveLabelIds = append(req.RemoveLabelIds, l.ids[name])
+	}
+
+	err := gmailDo(gmailThreadsModify, func() error {
+		_, err := l.srv.Users.Threads.Modify("me", thread.Id, req).Do()
+		return err
+	})
+	if err != nil {
+		return change, err
+	}
+	change.Applied = true
+	return change, nil
+}
+
+// webGmailLabel previews the label change for a thread on GET and writes it
+// to Gmail on POST.
+func webGmailLabel(w http.ResponseWriter, r *http.Request) error {
+	account, threadID := splitAccountPath(r.URL.Path, "/gmailLabel/")
+	threadID = strings.Trim(threadID, "/")
+	if len(account) == 0 {
+		redirectToAccount(w, r, "/gmailFetch/")
+		return nil
+	}
+	dryRun := r.Method != "POST" || !*writeLabels
+
+	srv, err := webGmailService(w, r, account)
+	if err != nil || srv == nil {
+		return err
+	}
+
+	var thread *gmail.Thread
+	err = gmailDo(gmailThreadsGet, func() (err error) {
+		thread, err = srv.Users.Threads.Get("me", threadID).Do()
+		return err
+	})
+	if err != nil {
+		return gmailError("Unable to retrieve thread "+threadID, err)
+	}
+
+	labeler, err := newGmailLabeler(srv, dryRun)
+	if err != nil {
+		return gmailError("Unable to retrieve labels", err)
+	}
+
+	results, err := classifyMails(threadMessages(thread))
+	if err != nil {
+		return err
+	}
+	change, err := labeler.apply(thread, results)
+	if err != nil {
+		return gmailError("Unable to label thread "+threadID, err)
+	}
+
+	return renderPage(w, "gmail-label.html", "Label thread", account, struct {
+		Account  string
+		Change   LabelChange
+		CanWrite bool
+	}{account, change, *writeLabels})
+}
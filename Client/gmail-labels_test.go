@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func labeledThread(id string, labelIDs ...string) *gmail.Thread {
+	return &gmail.Thread{Id: id, HistoryId: 1, Messages: []*gmail.Message{{Id: id + "-1", ThreadId: id, LabelIds: labelIDs}}}
+}
+
+func TestGmailLabelerApply(t *testing.T) {
+	f := newFakeGmail()
+	f.labels = []*gmail.Label{
+		{Id: "INBOX", Name: "INBOX", Type: "system"},
+		{Id: "Label_old", Name: "Classifier/Old", Type: "user"},
+	}
+	f.threads["t1"] = labeledThread("t1", "INBOX", "Label_old")
+	srv := f.start(t)
+
+	labeler, err := newGmailLabeler(srv, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change, err := labeler.apply(f.threads["t1"], []ClassificationResult{{"Physics", 0.8}, {"Old", 0.1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := LabelChange{ThreadID: "t1", Add: "Classifier/Physics", Remove: []string{"Classifier/Old"}, Applied: true}
+	if !reflect.DeepEqual(change, want) {
+		t.Errorf("change = %+v, want %+v", change, want)
+	}
+	if want := []string{"Classifier", "Classifier/Physics"}; !reflect.DeepEqual(f.created, want) {
+		t.Errorf("created labels %v, want %v", f.created, want)
+	}
+	modified := f.modified["t1"]
+	if len(modified) != 1 {
+		t.Fatalf("thread modified %d times, want once", len(modified))
+	}
+	if got, want := modified[0].AddLabelIds, []string{labeler.ids["Classifier/Physics"]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("added label IDs %v, want %v", got, want)
+	}
+	if got, want := modified[0].RemoveLabelIds, []string{"Label_old"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removed label IDs %v, want %v", got, want)
+	}
+
+	// the labels exist now, labeling another thread only modifies it
+	f.threads["t2"] = labeledThread("t2", "INBOX")
+	if _, err := labeler.apply(f.threads["t2"], []ClassificationResult{{"Physics", 0.5}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.created) != 2 || len(f.modified["t2"]) != 1 {
+		t.Errorf("second thread: created %v, modified %d times", f.created, len(f.modified["t2"]))
+	}
+}
+
+func TestGmailLabelerUpToDate(t *testing.T) {
+	f := newFakeGmail()
+	f.labels = []*gmail.Label{{Id: "Label_1", Name: "Classifier/Physics", Type: "user"}}
+	f.threads["t1"] = labeledThread("t1", "Label_1")
+	srv := f.start(t)
+
+	labeler, err := newGmailLabeler(srv, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change, err := labeler.apply(f.threads["t1"], []ClassificationResult{{"Physics", 0.8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Add != "" || len(change.Remove) > 0 || change.Applied {
+		t.Errorf("change = %+v, want none", change)
+	}
+	if len(f.modified) > 0 || len(f.created) > 0 {
+		t.Errorf("Gmail was changed: created %v, modified %v", f.created, f.modified)
+	}
+}
+
+func TestGmailLabelerDryRun(t *testing.T) {
+	f := newFakeGmail()
+	f.threads["t1"] = labeledThread("t1", "INBOX")
+	srv := f.start(t)
+
+	labeler, err := newGmailLabeler(srv, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change, err := labeler.apply(f.threads["t1"], []ClassificationResult{{"Physics", 0.8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Add != "Classifier/Physics" || change.Applied {
+		t.Errorf("change = %+v, want a preview adding Classifier/Physics", change)
+	}
+	for _, request := range f.requests {
+		if request != "GET /gmail/v1/users/me/labels" {
+			t.Errorf("dry run sent %s", request)
+		}
+	}
+}
+
+func TestGmailLabelerMissingThread(t *testing.T) {
+	f := newFakeGmail()
+	srv := f.start(t)
+
+	labeler, err := newGmailLabeler(srv, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := labeler.apply(labeledThread("gone"), []ClassificationResult{{"Physics", 0.8}}); err == nil {
+		t.Error("labeling a missing thread succeeded")
+	} else if !threadDeleted(err) {
+		t.Errorf("error %v is not a 404", err)
+	}
+}
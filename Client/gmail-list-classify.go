@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/gmail/v1"
+)
+
+// listClassifyWorkers is the number of threads of a page classified at once.
+const listClassifyWorkers = 4
+
+// ListedThread is a thread of the thread list with its classification.
+type ListedThread struct {
+	*gmail.Thread
+	Results  []ClassificationResult
+	Category string // top category, empty if the thread could not be classified
+	Score    float64
+	Cached   bool
+}
+
+// CategoryGroup holds the threads of a page with the same top category.
+type CategoryGroup struct {
+	Category string
+	Threads  []ListedThread
+}
+
+// listClassifications caches the classifications made for the thread list,
+// per account and thread ID, so paging back and forth does not ask the
+// classifier again.
+var listClassifications = struct {
+	sync.Mutex
+	accounts map[string]map[string]ClassifiedThread
+}{accounts: map[string]map[string]ClassifiedThread{}}
+
+// cachedClassification returns the classification of a thread made earlier
+// for the thread list or by the bulk job, as long as no message was added to
+// the thread since.
+func cachedClassification(account string, thread *gmail.Thread) ([]ClassificationResult, bool) {
+	listClassifications.Lock()
+	classified, ok := listClassifications.accounts[account][thread.Id]
+	listClassifications.Unlock()
+
+	if !ok {
+		classified, ok = classifyJobFor(account).result(thread.Id)
+	}
+	// results of older versions have no history ID, they are kept
+	if !ok || (classified.HistoryID != 0 && classified.HistoryID != thread.HistoryId) {
+		return nil, false
+	}
+	return classified.Results, true
+}
+
+func cacheClassification(account string, classified ClassifiedThread) {
+	listClassifications.Lock()
+	defer listClassifications.Unlock()
+
+	threads, ok := listClassifications.accounts[account]
+	if !ok {
+		threads = map[string]ClassifiedThread{}
+		listClassifications.accounts[account] = threads
+	}
+	threads[classified.ID] = classified
+}
+
+// classifyListedThreads classifies the threads of a page. Threads without a
+// cached classification are fetched with fetchThreads and classified
+// listClassifyWorkers at a time as they arrive. The order of the threads is
+// kept. Threads that fail are left without category, the first error is
+// returned along with the results.
+func classifyListedThreads(srv *gmailService, account string, threads []*gmail.Thread) ([]ListedThread, error) {
+	defer startQuotaBatch("the thread list of " + account).log()
+
+	listed := make([]ListedThread, len(threads))
+	errs := make([]error, len(threads))
+	indexes := map[string]int{}
+	missing := []*gmail.Thread{}
+	for i, thread := range threads {
+		listed[i] = ListedThread{Thread: thread}
+		if results, cached := cachedClassification(account, thread); cached {
+			listed[i].setResults(results, true)
+		} else {
+			indexes[thread.Id] = i
+			missing = append(missing, thread)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fetched := fetchThreads(ctx, srv, missing)
+
+	var wg sync.WaitGroup
+	for w := 0; w < listClassifyWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range fetched {
+				i := indexes[f.ID]
+				if f.Err != nil {
+					errs[i] = gmailError("Unable to retrieve thread "+f.ID, f.Err)
+					continue
+				}
+				results, err := classifyMails(f.Mails)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				cacheClassification(account, ClassifiedThread{ID: f.ID, HistoryID: f.Thread.HistoryId, Snippet: threads[i].Snippet, Results: results})
+				listed[i].setResults(results, false)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return listed, err
+		}
+	}
+	return listed, nil
+}
+
+func (listed *ListedThread) setResults(results []ClassificationResult, cached bool) {
+	listed.Results = results
+	listed.Cached = cached
+	if len(results) > 0 {
+		listed.Category = results[0].Category
+		listed.Score = results[0].Score
+	}
+}
+
+// CategoryCount is the number of threads of a page in a category.
+type CategoryCount struct {
+	Category string
+	Count    int
+}
+
+// countCategories counts the top categories of the threads, the most common
+// first.
+func countCategories(threads []ListedThread) []CategoryCount {
+	counts := map[string]int{}
+	for _, thread := range threads {
+		if len(thread.Category) > 0 {
+			counts[thread.Category]++
+		}
+	}
+	categories := []CategoryCount{}
+	for category, count := range counts {
+		categories = append(categories, CategoryCount{category, count})
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Count != categories[j].Count {
+			return categories[i].Count > categories[j].Count
+		}
+		return categories[i].Category < categories[j].Category
+	})
+	return categories
+}
+
+// groupThreads filters the threads to category, if given, and groups them by
+// top category in the order of categories. Without group all threads end up
+// in a single group.
+func groupThreads(threads []ListedThread, categories []CategoryCount, category string, group bool) []CategoryGroup {
+	if len(category) > 0 {
+		filtered := []ListedThread{}
+		for _, thread := range threads {
+			if thread.Category == category {
+				filtered = append(filtered, thread)
+			}
+		}
+		threads = filtered
+	}
+	if !group {
+		return []CategoryGroup{{Threads: threads}}
+	}
+
+	groups := []CategoryGroup{}
+	for _, c := range categories {
+		g := CategoryGroup{Category: c.Category}
+		for _, thread := range threads {
+			if thread.Category == c.Category {
+				g.Threads = append(g.Threads, thread)
+			}
+		}
+		if len(g.Threads) > 0 {
+			groups = append(groups, g)
+		}
+	}
+
+	unclassified := CategoryGroup{}
+	for _, thread := range threads {
+		if len(thread.Category) == 0 {
+			unclassified.Threads = append(unclassified.Threads, thread)
+		}
+	}
+	if len(unclassified.Threads) > 0 {
+		groups = append(groups, unclassified)
+	}
+	return groups
+}
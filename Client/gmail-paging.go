@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	listSessionCookie  = "gmail_list_session"
+	listSessionTimeout = 2 * time.Hour
+)
+
+// Gmail only hands out tokens for the next page. The thread list remembers
+// the token of every page a browser visited, so it can link back as well.
+
+// listSession holds the page tokens of one browser, one stack per account and
+// search. tokens[i] is the token of page i, page 0 has the empty token.
+type listSession struct {
+	stacks map[string][]string
+	used   time.Time
+}
+
+var listSessions = struct {
+	sync.Mutex
+	sessions map[string]*listSession
+}{sessions: map[string]*listSession{}}
+
+// pageStack is the stack of page tokens of one search in one session.
+type pageStack struct {
+	session string
+	key     string
+}
+
+// listSessionID returns the session of the browser, starting a new one with
+// a cookie if there is none yet.
+func listSessionID(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(listSessionCookie); err == nil && len(cookie.Value) > 0 {
+		return cookie.Value
+	}
+	id, err := randomState()
+	if err != nil {
+		// no back links then, the list works without them
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     listSessionCookie,
+		Value:    id,
+		Path:     "/gmailFetch/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// pageStackFor returns the page stack of the search q of account in the
+// browser's session. Filtering and grouping only change the view of a page,
+// they share the stack.
+func pageStackFor(w http.ResponseWriter, r *http.Request, account string, q threadQuery) pageStack {
+	return pageStack{
+		session: listSessionID(w, r),
+		key:     account + "\x00" + q.Query + "\x00" + q.Label + "\x00" + strconv.FormatInt(q.Size, 10),
+	}
+}
+
+// visit records that page has the given token and is followed by next and
+// returns the token of the page before it, if it is known.
+func (s pageStack) visit(page int, token, next string) (string, bool) {
+	if len(s.session) == 0 {
+		return "", false
+	}
+
+	listSessions.Lock()
+	defer listSessions.Unlock()
+
+	for id, session := range listSessions.sessions {
+		if time.Since(session.used) > listSessionTimeout {
+			delete(listSessions.sessions, id)
+		}
+	}
+	session, ok := listSessions.sessions[s.session]
+	if !ok {
+		session = &listSession{stacks: map[string][]string{}}
+		listSessions.sessions[s.session] = session
+	}
+	session.used = time.Now()
+
+	tokens := session.stacks[s.key]
+	if page >= len(tokens) || tokens[page] != token {
+		// reached from a stale or foreign link, the tokens before it are
+		// only known as far as this session got
+		if page >= len(tokens) {
+			known := tokens
+			tokens = make([]string, page+1)
+			copy(tokens, known)
+		}
+		tokens[page] = token
+	}
+	tokens = append(tokens[:page+1], next)
+	session.stacks[s.key] = tokens
+
+	if page == 0 || (page > 1 && len(tokens[page-1]) == 0) {
+		return "", false
+	}
+	return tokens[page-1], true
+}
+
+// pageCount estimates the number of pages from Gmail's estimate of the
+// number of threads.
+func pageCount(estimate, size int64) int64 {
+	if size <= 0 {
+		return 0
+	}
+	return (estimate + size - 1) / size
+}
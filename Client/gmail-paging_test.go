@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type pageVisit struct {
+	page        int
+	token, next string
+	expire      bool // let the session time out before the visit
+
+	prev   string
+	prevOK bool
+}
+
+func TestPageStackVisit(t *testing.T) {
+	tests := []struct {
+		name   string
+		visits []pageVisit
+	}{
+		{"forward", []pageVisit{
+			{page: 0, next: "t1"},
+			{page: 1, token: "t1", next: "t2", prevOK: true},
+			{page: 2, token: "t2", next: "t3", prev: "t1", prevOK: true},
+		}},
+		{"back", []pageVisit{
+			{page: 0, next: "t1"},
+			{page: 1, token: "t1", next: "t2", prevOK: true},
+			{page: 2, token: "t2", next: "t3", prev: "t1", prevOK: true},
+			{page: 1, token: "t1", next: "t2", prevOK: true},
+			{page: 2, token: "t2", next: "t3", prev: "t1", prevOK: true},
+		}},
+		{"0 then 2 from an older tab", []pageVisit{
+			{page: 0, next: "t1"},
+			{page: 2, token: "t2", next: "t3", prev: "t1", prevOK: true},
+			{page: 3, token: "t3", next: "t4", prev: "t2", prevOK: true},
+		}},
+		{"1, 0, 2", []pageVisit{
+			{page: 1, token: "t1", next: "t2", prevOK: true},
+			{page: 0, next: "t1"},
+			{page: 2, token: "t2", next: "t3", prev: "t1", prevOK: true},
+		}},
+		{"deep link", []pageVisit{
+			{page: 3, token: "t3", next: "t4"},
+			{page: 4, token: "t4", next: "t5", prev: "t3", prevOK: true},
+		}},
+		{"stale token", []pageVisit{
+			{page: 0, next: "t1"},
+			{page: 1, token: "t1", next: "t2", prevOK: true},
+			{page: 2, token: "t2", next: "t3", prev: "t1", prevOK: true},
+			{page: 2, token: "u2", next: "u3", prev: "t1", prevOK: true},
+			{page: 3, token: "u3", next: "u4", prev: "u2", prevOK: true},
+		}},
+		{"expired session", []pageVisit{
+			{page: 0, next: "t1"},
+			{page: 1, token: "t1", next: "t2", prevOK: true},
+			{page: 2, token: "t2", next: "t3", expire: true},
+			{page: 3, token: "t3", next: "t4", prev: "t2", prevOK: true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := pageStack{session: "test " + tt.name, key: "account\x00\x00INBOX\x0030"}
+			for i, v := range tt.visits {
+				if v.expire {
+					listSessions.Lock()
+					listSessions.sessions[s.session].used = time.Now().Add(-2 * listSessionTimeout)
+					listSessions.Unlock()
+				}
+				prev, ok := s.visit(v.page, v.token, v.next)
+				if prev != v.prev || ok != v.prevOK {
+					t.Errorf("visit %d of page %d = %q, %v, want %q, %v", i, v.page, prev, ok, v.prev, v.prevOK)
+				}
+			}
+		})
+	}
+}
+
+func TestPageStackWithoutSession(t *testing.T) {
+	if prev, ok := (pageStack{}).visit(2, "t2", "t3"); ok {
+		t.Errorf("visit without a session = %q, true", prev)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Gmail limits every user to 250 quota units a second, each method costs a
+// fixed number of units. All calls go through gmailDo, which waits until the
+// shared limiter has enough units and retries the call with exponential
+// backoff if Gmail answers that the limit was exceeded anyway.
+
+// gmailMethod is a Gmail API method with its cost in quota units, see
+// https://developers.google.com/gmail/api/reference/quota
+type gmailMethod struct {
+	Name  string
+	Units int
+}
+
+var (
+	gmailGetProfile    = gmailMethod{"users.getProfile", 1}
+	gmailThreadsList   = gmailMethod{"threads.list", 10}
+	gmailThreadsGet    = gmailMethod{"threads.get", 10}
+	gmailThreadsModify = gmailMethod{"threads.modify", 10}
+	gmailLabelsList    = gmailMethod{"labels.list", 1}
+	gmailLabelsCreate  = gmailMethod{"labels.create", 5}
+	gmailHistoryList   = gmailMethod{"history.list", 2}
+)
+
+// gmailLimiter is a token bucket of quota units. It starts full, so short
+// bursts of up to a second's worth of units are not delayed.
+type gmailLimiter struct {
+	sync.Mutex
+	units float64
+	last  time.Time
+}
+
+var gmailRate = &gmailLimiter{}
+
+// wait blocks until n units are available and takes them. It returns how
+// long it waited.
+func (l *gmailLimiter) wait(n int) time.Duration {
+	rate := float64(*gmailQuotaRate)
+	if rate <= 0 {
+		return 0
+	}
+	need := float64(n)
+	if need > rate {
+		// a call never needs more than the bucket holds
+		need = rate
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.units = rate
+	} else {
+		l.units += now.Sub(l.last).Seconds() * rate
+		if l.units > rate {
+			l.units = rate
+		}
+	}
+	l.last = now
+
+	var waited time.Duration
+	if l.units < need {
+		// waiting under the lock queues the other callers behind this one
+		waited = time.Duration((need - l.units) / rate * float64(time.Second))
+		time.Sleep(waited)
+		l.units = need
+		l.last = time.Now()
+	}
+	l.units -= need
+	return waited
+}
+
+// waitAll waits for n calls of the given units each, e.g. for a batch.
+func (l *gmailLimiter) waitAll(units, n int) time.Duration {
+	var waited time.Duration
+	for i := 0; i < n; i++ {
+		waited += l.wait(units)
+	}
+	return waited
+}
+
+// methodUsage is what was spent on one method.
+type methodUsage struct {
+	Calls    int
+	Units    int
+	Retries  int
+	Failures int
+}
+
+// gmailUsage counts the quota spent since the start, see quotaBatch.
+type gmailUsage struct {
+	Methods map[string]methodUsage
+	Waited  time.Duration
+	Backoff time.Duration
+}
+
+var gmailQuota = struct {
+	sync.Mutex
+	usage gmailUsage
+}{usage: gmailUsage{Methods: map[string]methodUsage{}}}
+
+func recordGmailUsage(method gmailMethod, update func(*methodUsage), waited, backoff time.Duration) {
+	gmailQuota.Lock()
+	defer gmailQuota.Unlock()
+	m := gmailQuota.usage.Methods[method.Name]
+	update(&m)
+	gmailQuota.usage.Methods[method.Name] = m
+	gmailQuota.usage.Waited += waited
+	gmailQuota.usage.Backoff += backoff
+}
+
+// validateGmailFlags checks the flags limiting the Gmail API calls.
+func validateGmailFlags() error {
+	if *gmailQuotaRate < 0 {
+		return fmt.Errorf("-gmail-quota-rate must not be negative, got %d", *gmailQuotaRate)
+	}
+	if *gmailRetries < 0 {
+		return fmt.Errorf("-gmail-retries must not be negative, got %d", *gmailRetries)
+	}
+	if *gmailMaxBackoff <= 0 {
+		return fmt.Errorf("-gmail-max-backoff must be positive, got %v", *gmailMaxBackoff)
+	}
+	return nil
+}
+
+// gmailDo runs a Gmail API call once the limiter allows it, do must make
+// exactly one call of method. Calls failing with a rate limit or a server
+// error are retried -gmail-retries times with jittered exponential backoff.
+func gmailDo(method gmailMethod, do func() error) error {
+	for attempt := 0; ; attempt++ {
+		waited := gmailRate.wait(method.Units)
+		err := do()
+		recordGmailUsage(method, func(m *methodUsage) {
+			m.Calls++
+			m.Units += method.Units
+		}, waited, 0)
+		if err == nil {
+			return nil
+		}
+
+		retry, after := retryableGmailError(err)
+		if !retry || attempt >= *gmailRetries {
+			recordGmailUsage(method, func(m *methodUsage) { m.Failures++ }, 0, 0)
+			return err
+		}
+		backoff := gmailBackoff(attempt, after)
+		log.Printf("Gmail %s failed, retrying in %v: %v", method.Name, backoff.Round(time.Millisecond), err)
+		recordGmailUsage(method, func(m *methodUsage) { m.Retries++ }, 0, backoff)
+		time.Sleep(backoff)
+	}
+}
+
+// retryableGmailError reports whether a failed call may succeed when it is
+// repeated later: exceeded rate limits, server errors and network timeouts.
+// The delay Gmail asked for with Retry-After is returned as well.
+func retryableGmailError(err error) (bool, time.Duration) {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		var after time.Duration
+		if seconds, err := strconv.Atoi(apiErr.Header.Get("Retry-After")); err == nil {
+			after = time.Duration(seconds) * time.Second
+		}
+		switch apiErr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, after
+		case http.StatusForbidden:
+			// quota errors are a 403 with one of these reasons, other 403s
+			// are missing permissions
+			for _, item := range apiErr.Errors {
+				switch item.Reason {
+				case "rateLimitExceeded", "userRateLimitExceeded":
+					return true, after
+				}
+			}
+		}
+		return false, 0
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, 0
+	}
+	return false, 0
+}
+
+// gmailBackoffDoublings is how often the backoff doubles at most, one second
+// doubled more often than this overflows a time.Duration.
+const gmailBackoffDoublings = 32
+
+// gmailBackoff returns how long to wait before the next attempt: a random
+// duration up to one second doubled with every attempt, at most
+// -gmail-max-backoff, but never less than Gmail asked for.
+func gmailBackoff(attempt int, after time.Duration) time.Duration {
+	if attempt > gmailBackoffDoublings {
+		attempt = gmailBackoffDoublings
+	}
+	ceiling := time.Second << uint(attempt)
+	if ceiling > *gmailMaxBackoff {
+		ceiling = *gmailMaxBackoff
+	}
+	backoff := time.Duration(rand.Int63n(int64(ceiling)/2+1)) + ceiling/2
+	if backoff < after {
+		backoff = after
+	}
+	return backoff
+}
+
+// quotaBatch measures the quota spent by a batch of work, e.g. one run of the
+// classification job.
+type quotaBatch struct {
+	name  string
+	start time.Time
+	usage gmailUsage
+}
+
+func startQuotaBatch(name string) quotaBatch {
+	gmailQuota.Lock()
+	defer gmailQuota.Unlock()
+	usage := gmailQuota.usage
+	usage.Methods = map[string]methodUsage{}
+	for name, m := range gmailQuota.usage.Methods {
+		usage.Methods[name] = m
+	}
+	return quotaBatch{name, time.Now(), usage}
+}
+
+// log writes what the batch spent since it started.
+func (b quotaBatch) log() {
+	gmailQuota.Lock()
+	defer gmailQuota.Unlock()
+
+	units, calls, retries, failures := 0, 0, 0, 0
+	methods := []string{}
+	for name, m := range gmailQuota.usage.Methods {
+		before := b.usage.Methods[name]
+		if m.Calls == before.Calls {
+			continue
+		}
+		units += m.Units - before.Units
+		calls += m.Calls - before.Calls
+		retries += m.Retries - before.Retries
+		failures += m.Failures - before.Failures
+		methods = append(methods, fmt.Sprintf("%s %d", name, m.Calls-before.Calls))
+	}
+	if calls == 0 {
+		return
+	}
+	sort.Strings(methods)
+
+	elapsed := time.Since(b.start)
+	log.Printf("Gmail quota for %s: %d units in %d calls (%s) in %v, %.0f units/s, %d retries, %d failed, waited %v for the rate limit and %v in backoff",
+		b.name, units, calls, strings.Join(methods, ", "), elapsed.Round(time.Millisecond),
+		float64(units)/elapsed.Seconds(), retries, failures,
+		(gmailQuota.usage.Waited - b.usage.Waited).Round(time.Millisecond),
+		(gmailQuota.usage.Backoff - b.usage.Backoff).Round(time.Millisecond))
+}
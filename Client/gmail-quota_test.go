@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGmailBackoff(t *testing.T) {
+	maxBackoff := *gmailMaxBackoff
+	*gmailMaxBackoff = 32 * time.Second
+	defer func() { *gmailMaxBackoff = maxBackoff }()
+
+	tests := []struct {
+		attempt  int
+		after    time.Duration
+		min, max time.Duration
+	}{
+		{0, 0, time.Second / 2, time.Second},
+		{3, 0, 4 * time.Second, 8 * time.Second},
+		{10, 0, 16 * time.Second, 32 * time.Second},
+		{40, 0, 16 * time.Second, 32 * time.Second},
+		{1000, 0, 16 * time.Second, 32 * time.Second},
+		{0, time.Minute, time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := gmailBackoff(tt.attempt, tt.after); got < tt.min || got > tt.max {
+			t.Errorf("gmailBackoff(%d, %v) = %v, want between %v and %v", tt.attempt, tt.after, got, tt.min, tt.max)
+		}
+	}
+
+	*gmailMaxBackoff = 1 << 62
+	if got := gmailBackoff(1000, 0); got <= 0 {
+		t.Errorf("gmailBackoff(1000, 0) = %v without a limit", got)
+	}
+}
+
+func TestValidateGmailFlags(t *testing.T) {
+	rate, retries, maxBackoff := *gmailQuotaRate, *gmailRetries, *gmailMaxBackoff
+	defer func() { *gmailQuotaRate, *gmailRetries, *gmailMaxBackoff = rate, retries, maxBackoff }()
+
+	tests := []struct {
+		rate, retries int
+		maxBackoff    time.Duration
+		ok            bool
+	}{
+		{250, 5, 32 * time.Second, true},
+		{0, 0, time.Millisecond, true},
+		{-1, 5, 32 * time.Second, false},
+		{250, -1, 32 * time.Second, false},
+		{250, 5, 0, false},
+		{250, 5, -time.Second, false},
+	}
+	for _, tt := range tests {
+		*gmailQuotaRate, *gmailRetries, *gmailMaxBackoff = tt.rate, tt.retries, tt.maxBackoff
+		if err := validateGmailFlags(); (err == nil) != tt.ok {
+			t.Errorf("validateGmailFlags with rate %d, retries %d, max backoff %v: %v", tt.rate, tt.retries, tt.maxBackoff, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	defaultThreadPageSize = 30
+	maxThreadPageSize     = 500 // the most Gmail returns per page
+)
+
+// threadPageSizes are offered in the page size picker of the thread list.
+var threadPageSizes = []int64{10, 30, 50, 100, 200}
+
+// threadQuery selects the threads shown in the thread list.
+type threadQuery struct {
+	Query    string // Gmail search, e.g. "from:me has:attachment"
+	Label    string // label ID, empty for all mail
+	Size     int64
+	Category string // only show threads classified as this category
+	Group    bool   // group the threads by category
+}
+
+// threadQueryFrom reads the search from the request parameters q, label and
+// size. Without a label parameter the inbox is shown.
+func threadQueryFrom(r *http.Request) threadQuery {
+	q := threadQuery{
+		Query:    r.FormValue("q"),
+		Label:    "INBOX",
+		Size:     defaultThreadPageSize,
+		Category: r.FormValue("category"),
+		Group:    len(r.FormValue("group")) > 0,
+	}
+	if _, ok := r.Form["label"]; ok {
+		q.Label = r.FormValue("label")
+	}
+	if size, err := strconv.ParseInt(r.FormValue("size"), 10, 64); err == nil && size > 0 {
+		q.Size = size
+		if q.Size > maxThreadPageSize {
+			q.Size = maxThreadPageSize
+		}
+	}
+	return q
+}
+
+// Params encodes the query for links to other pages of the same list. It is
+// a template.URL so the template keeps the separators.
+func (q threadQuery) Params() template.URL {
+	params := url.Values{
+		"q":     {q.Query},
+		"label": {q.Label},
+		"size":  {strconv.FormatInt(q.Size, 10)},
+	}
+	if len(q.Category) > 0 {
+		params.Set("category", q.Category)
+	}
+	if q.Group {
+		params.Set("group", "1")
+	}
+	return template.URL(params.Encode())
+}
+
+// WithCategory returns the query filtered to category, or unfiltered for "".
+func (q threadQuery) WithCategory(category string) threadQuery {
+	q.Category = category
+	return q
+}
+
+// WithGroup returns the query with grouping switched on or off.
+func (q threadQuery) WithGroup(group bool) threadQuery {
+	q.Group = group
+	return q
+}
+
+// pageSizes returns the page sizes to offer, including the current one.
+func pageSizes(current int64) []int64 {
+	for _, size := range threadPageSizes {
+		if size == current {
+			return threadPageSizes
+		}
+	}
+	return append([]int64{current}, threadPageSizes...)
+}
+
+// listThreads returns one page of the threads matching q.
+func listThreads(srv *gmailService, q threadQuery, pageToken string) (*gmail.ListThreadsResponse, error) {
+	call := srv.Users.Threads.List("me").MaxResults(q.Size).PageToken(pageToken)
+	if len(q.Label) > 0 {
+		call = call.LabelIds(q.Label)
+	}
+	if len(q.Query) > 0 {
+		call = call.Q(q.Query)
+	}
+	var r *gmail.ListThreadsResponse
+	err := gmailDo(gmailThreadsList, func() (err error) {
+		r, err = call.Do()
+		return err
+	})
+	return r, err
+}
+
+// listLabels returns the labels of the mailbox for the label picker, system
+// labels like INBOX first and then the user's labels by name.
+func listLabels(srv *gmailService) ([]*gmail.Label, error) {
+	var r *gmail.ListLabelsResponse
+	err := gmailDo(gmailLabelsList, func() (err error) {
+		r, err = srv.Users.Labels.List("me").Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	labels := r.Labels
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Type != labels[j].Type {
+			return labels[i].Type == "system"
+		}
+		return labels[i].Name < labels[j].Name
+	})
+	return labels, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// TokenStatus describes the stored token of one account.
+type TokenStatus struct {
+	Account   string
+	Encrypted bool
+	Refresh   bool // a refresh token is stored
+	Expiry    time.Time
+	ExpiresIn time.Duration
+	Scopes    []string
+	ScopeErr  string
+	Refreshed bool // the token expired and was refreshed just now
+	Error     string
+}
+
+// gmailTokenStatus reads the token of account, refreshing it if it expired,
+// and asks Google which scopes it grants.
+func gmailTokenStatus(account string) TokenStatus {
+	status := TokenStatus{Account: account}
+
+	config, err := gmailConfig()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	cacheFile, err := tokenCacheFile(account)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	b, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Encrypted = isEncryptedToken(b)
+
+	tok, err := tokenFromFile(cacheFile)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Refresh = len(tok.RefreshToken) > 0
+
+	stored := tok.AccessToken
+	tok, err = newSavingTokenSource(context.Background(), config, cacheFile, tok).Token()
+	if err != nil {
+		status.Error = "refresh failed: " + err.Error()
+		return status
+	}
+	status.Expiry = tok.Expiry
+	status.ExpiresIn = time.Until(tok.Expiry).Truncate(time.Second)
+	status.Refreshed = tok.AccessToken != stored
+
+	status.Scopes, err = tokenScopes(tok.AccessToken)
+	if err != nil {
+		status.ScopeErr = err.Error()
+	}
+	return status
+}
+
+// tokenScopes asks Google's tokeninfo endpoint for the scopes an access token
+// grants, they are not part of the stored token.
+func tokenScopes(accessToken string) ([]string, error) {
+	resp, err := http.Get(tokenInfoURL + "?access_token=" + url.QueryEscape(accessToken))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo: %s", resp.Status)
+	}
+
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+func webGmailSettings(w http.ResponseWriter, r *http.Request) error {
+	tokens := []TokenStatus{}
+	for _, account := range listGmailAccounts() {
+		status := gmailTokenStatus(account)
+		if len(status.Error) > 0 {
+			log.Printf("Token of %s: %s", account, status.Error)
+		}
+		tokens = append(tokens, status)
+	}
+
+	return renderPage(w, "gmail-settings.html", "Settings", "", struct {
+		Scope     string
+		Encrypted bool
+		Tokens    []TokenStatus
+	}{gmailScope(), len(tokenCacheKey) > 0, tokens})
+}
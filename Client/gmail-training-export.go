@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/gmail/v1"
+)
+
+// The training export turns the user's own Gmail labels into training data,
+// one file per label in trainingData/ like the crawled categories, so the
+// classifier learns the folders the mail is actually sorted into. The files
+// use the format of the crawler, a JSON array of QuoraAnswer with the thread
+// text as Answer, which is what the server's FileLabelAwareIterator reads.
+
+const (
+	trainingDataDir = "trainingData"
+	// trainingFileMaxDocs is the most documents a training file may hold,
+	// the server reads a file into a queue of this size.
+	trainingFileMaxDocs = 200
+	gmailThreadURL      = "https://mail.google.com/mail/#all/"
+)
+
+// exportedLabel is the result of exporting one label.
+type exportedLabel struct {
+	Label   string
+	File    string
+	Threads int // threads of the label written
+	Kept    int // documents of other sources kept in the file
+	Skipped int // threads without text or failing to load
+	Err     string
+}
+
+// trainingLabels returns the user's own labels, without the system labels
+// and the labels written by the classifier, which would only teach it its
+// own guesses.
+func trainingLabels(srv *gmailService) ([]*gmail.Label, error) {
+	labels, err := listLabels(srv)
+	if err != nil {
+		return nil, err
+	}
+	user := []*gmail.Label{}
+	for _, label := range labels {
+		if label.Type == "system" || label.Name == classifierLabelRoot || strings.HasPrefix(label.Name, classifierLabelRoot+"/") {
+			continue
+		}
+		user = append(user, label)
+	}
+	return user, nil
+}
+
+// trainingFileName returns the file of a label in trainingData/. The server
+// takes the file name up to the last '.' as the category, so everything but
+// letters, digits, '-' and '_' is replaced, e.g. "Work/Team 2" is written to
+// "Work-Team-2.json".
+func trainingFileName(label string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, label)
+	name = strings.Trim(name, "-")
+	if len(name) == 0 {
+		name = "label"
+	}
+	return filepath.Join(trainingDataDir, name+".json")
+}
+
+// isGmailDocument reports whether a training document was exported from
+// Gmail for label, rather than crawled or exported from another label that
+// maps to the same file.
+func isGmailDocument(doc QuoraAnswer, label string) bool {
+	return strings.HasPrefix(doc.URL, gmailThreadURL) && len(doc.Categories) > 0 && doc.Categories[0] == label
+}
+
+// exportLabel writes up to limit threads of label to its training file. The
+// documents the file already holds from other sources are kept, those from
+// an earlier export of the label are replaced.
+func exportLabel(ctx context.Context, srv *gmailService, label *gmail.Label, limit int) exportedLabel {
+	result := exportedLabel{Label: label.Name, File: trainingFileName(label.Name)}
+
+	docs := []QuoraAnswer{}
+	existing := []QuoraAnswer{}
+	if err := loadJSON(result.File, &existing); err != nil {
+		result.Err = "Unable to read " + result.File + ": " + err.Error()
+		return result
+	}
+	for _, doc := range existing {
+		if !isGmailDocument(doc, label.Name) {
+			docs = append(docs, doc)
+		}
+	}
+	result.Kept = len(docs)
+	if limit > trainingFileMaxDocs-len(docs) {
+		limit = trainingFileMaxDocs - len(docs)
+	}
+	if limit <= 0 {
+		result.Err = result.File + " is full with documents of other sources"
+		return result
+	}
+
+	threads := []*gmail.Thread{}
+	pageToken := ""
+	for len(threads) < limit {
+		size := int64(limit - len(threads))
+		if size > maxThreadPageSize {
+			size = maxThreadPageSize
+		}
+		r, err := listThreads(srv, threadQuery{Label: label.Id, Size: size}, pageToken)
+		if err != nil {
+			result.Err = gmailError("Unable to list the threads of "+label.Name, err).Error()
+			return result
+		}
+		threads = append(threads, r.Threads...)
+		if len(r.NextPageToken) == 0 {
+			break
+		}
+		pageToken = r.NextPageToken
+	}
+	if len(threads) > limit {
+		threads = threads[:limit]
+	}
+
+	// the threads are written in the order Gmail lists them, newest first
+	order := map[string]int{}
+	for i, thread := range threads {
+		order[thread.Id] = i
+	}
+	exported := []QuoraAnswer{}
+	for fetched := range fetchThreads(ctx, srv, threads) {
+		if fetched.Err != nil {
+			log.Printf("Unable to export thread %s of %s: %v", fetched.ID, label.Name, fetched.Err)
+			result.Skipped++
+			continue
+		}
+		text := strings.TrimSpace(threadText(fetched.Mails))
+		if len(text) == 0 {
+			result.Skipped++
+			continue
+		}
+		subject := ""
+		if len(fetched.Mails) > 0 {
+			subject = fetched.Mails[0].Subject
+		}
+		exported = append(exported, QuoraAnswer{
+			Question:   subject,
+			Answer:     text,
+			Categories: []string{label.Name},
+			ID:         fetched.ID,
+			URL:        gmailThreadURL + fetched.ID,
+		})
+	}
+	if err := ctx.Err(); err != nil {
+		result.Err = "Export of " + label.Name + " stopped: " + err.Error()
+		return result
+	}
+	sort.Slice(exported, func(i, j int) bool { return order[exported[i].ID] < order[exported[j].ID] })
+	result.Threads = len(exported)
+
+	docs = append(docs, exported...)
+	if len(docs) == 0 {
+		// the server expects at least one document in every file
+		os.Remove(result.File)
+		return result
+	}
+	if err := os.MkdirAll(trainingDataDir, 0755); err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	if err := writeTrainingFile(result.File, docs); err != nil {
+		result.Err = "Unable to write " + result.File + ": " + err.Error()
+	}
+	return result
+}
+
+// writeTrainingFile replaces the file at path in trainingData/ with docs. The
+// server reads every file in trainingData/ as a category, so the temporary
+// file is written next to the directory and then renamed into it. The file is
+// readable by everyone like the crawled ones.
+func writeTrainingFile(path string, docs []QuoraAnswer) error {
+	b, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(trainingDataDir), trainingDataDir+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// webGmailExportLabels lists the user's labels on GET and writes the selected
+// ones to trainingData/ on POST.
+func webGmailExportLabels(w http.ResponseWriter, r *http.Request) error {
+	account, _ := splitAccountPath(r.URL.Path, "/gmailExportLabels/")
+	if len(account) == 0 {
+		redirectToAccount(w, r, "/gmailExportLabels/")
+		return nil
+	}
+
+	srv, err := webGmailService(w, r, account)
+	if err != nil || srv == nil {
+		return err
+	}
+	labels, err := trainingLabels(srv)
+	if err != nil {
+		return gmailError("Unable to retrieve labels", err)
+	}
+
+	limit := trainingFileMaxDocs
+	if n, err := strconv.Atoi(r.FormValue("max")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	selected := map[string]bool{}
+	for _, id := range r.Form["label"] {
+		selected[id] = true
+	}
+
+	results := []exportedLabel{}
+	if r.Method == "POST" {
+		batch := startQuotaBatch("training export of " + account)
+		for _, label := range labels {
+			if !selected[label.Id] {
+				continue
+			}
+			result := exportLabel(r.Context(), srv, label, limit)
+			if len(result.Err) > 0 {
+				log.Print(result.Err)
+			} else {
+				log.Printf("Exported %d threads of label %s to %s", result.Threads, label.Name, result.File)
+			}
+			results = append(results, result)
+		}
+		batch.log()
+	}
+
+	return renderPage(w, "gmail-export.html", "Export labels", account, struct {
+		Account  string
+		Labels   []*gmail.Label
+		Selected map[string]bool
+		Max      int
+		Results  []exportedLabel
+	}{account, labels, selected, limit, results})
+}
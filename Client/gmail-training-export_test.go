@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteTrainingFile(t *testing.T) {
+	inTempDir(t)
+	if err := os.Mkdir(trainingDataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(trainingDataDir, "Invoices.json")
+	for _, answer := range []string{"first", "second"} {
+		if err := writeTrainingFile(path, []QuoraAnswer{{Answer: answer}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(trainingDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "Invoices.json" {
+		for _, file := range files {
+			t.Errorf("%s in %s", file.Name(), trainingDataDir)
+		}
+	}
+	if mode := files[0].Mode().Perm(); mode != 0644 {
+		t.Errorf("mode %v, want 0644", mode)
+	}
+	docs := []QuoraAnswer{}
+	if err := loadJSON(path, &docs); err != nil || len(docs) != 1 || docs[0].Answer != "second" {
+		t.Errorf("read back %+v, %v", docs, err)
+	}
+	if others, _ := filepath.Glob(trainingDataDir + "-*"); len(others) > 0 {
+		t.Errorf("temporary files left behind: %v", others)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"net/mail"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerPriorsFile = "header-priors.json"
+	// headerPriorStrength is the number of classified mails after which a
+	// signal counts half as much as it can
+	headerPriorStrength   = 10
+	headerPriorsSaveDelay = 10 * time.Second
+	// headerPriorsMaxLearned is the number of mails remembered as counted,
+	// the oldest are forgotten and counted again if classified again
+	headerPriorsMaxLearned = 20000
+)
+
+// The text classifier only sees the body. Mail from the same sender or
+// mailing list is usually about the same topic, so the classifier learns
+// which categories the text of mails with a header signal got and shifts the
+// scores of new mails with that signal towards them.
+//
+// Signals are keys like "domain:example.com", "list:news.example.com",
+// "gmail:CATEGORY_PROMOTIONS" or "bulk".
+
+// mailSignals returns the header signals of a thread. The sender and lists are
+// taken from the first message, which started the thread.
+func mailSignals(mails []MailMessage) []string {
+	if len(mails) == 0 {
+		return nil
+	}
+	first := mails[0]
+	signals := []string{}
+	if domain := senderDomain(first.From); len(domain) > 0 {
+		signals = append(signals, "domain:"+domain)
+	}
+	if len(first.ListID) > 0 {
+		signals = append(signals, "list:"+first.ListID)
+	}
+	for _, label := range first.Labels {
+		if strings.HasPrefix(label, "CATEGORY_") {
+			signals = append(signals, "gmail:"+label)
+		}
+	}
+	for _, msg := range mails {
+		if msg.Bulk {
+			signals = append(signals, "bulk")
+			break
+		}
+	}
+	return signals
+}
+
+// senderDomain returns the lower case domain of a From header.
+func senderDomain(from string) string {
+	address := from
+	if addr, err := mail.ParseAddress(from); err == nil {
+		address = addr.Address
+	}
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(address[at+1:], "<> "))
+}
+
+// listID returns the identifier of a List-Id header, e.g. "news.example.com"
+// for "Example News <news.example.com>".
+func listID(header string) string {
+	if start := strings.LastIndex(header, "<"); start >= 0 {
+		if end := strings.Index(header[start:], ">"); end > 0 {
+			return strings.ToLower(header[start+1 : start+end])
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(header))
+}
+
+// isBulkMail reports whether the headers mark a mail as sent to many, a
+// newsletter or an automatic notification.
+func isBulkMail(precedence, listUnsubscribe string) bool {
+	switch strings.ToLower(strings.TrimSpace(precedence)) {
+	case "bulk", "list", "junk":
+		return true
+	}
+	return len(listUnsubscribe) > 0
+}
+
+// headerPriors counts the top text category of the mails seen with each
+// signal. LearnedMails maps the hash of a Message-ID to what it was counted
+// for, so classifying a mail again does not count it twice. LearnedOrder holds
+// the same hashes from the first counted on, to forget the oldest beyond
+// headerPriorsMaxLearned.
+type headerPriors struct {
+	Counts       map[string]map[string]int
+	LearnedMails map[string]learnedMail
+	LearnedOrder []string
+}
+
+// learnedMail is the category a mail was counted for and the signals it was
+// counted with.
+type learnedMail struct {
+	Category string
+	Signals  []string
+}
+
+var priors = struct {
+	sync.Mutex
+	loaded bool
+	data   headerPriors
+	dirty  bool
+	saved  time.Time
+}{}
+
+// loadPriors reads the priors on first use, the caller must hold the lock.
+func loadPriors() {
+	if priors.loaded {
+		return
+	}
+	priors.loaded = true
+	priors.data = headerPriors{Counts: map[string]map[string]int{}, LearnedMails: map[string]learnedMail{}}
+	if err := loadJSON(headerPriorsFile, &priors.data); err != nil {
+		log.Printf("Unable to load header priors: %v", err)
+	}
+	if priors.data.Counts == nil {
+		priors.data.Counts = map[string]map[string]int{}
+	}
+	if priors.data.LearnedMails == nil {
+		priors.data.LearnedMails = map[string]learnedMail{}
+	}
+	if len(priors.data.LearnedOrder) != len(priors.data.LearnedMails) {
+		// written without the order, which one is older is unknown
+		priors.data.LearnedOrder = make([]string, 0, len(priors.data.LearnedMails))
+		for key := range priors.data.LearnedMails {
+			priors.data.LearnedOrder = append(priors.data.LearnedOrder, key)
+		}
+		sort.Strings(priors.data.LearnedOrder)
+		forgetLearned()
+	}
+}
+
+// learnedKey shortens a Message-ID to the key of headerPriors.LearnedMails.
+func learnedKey(messageID string) string {
+	h := fnv.New64a()
+	h.Write([]byte(messageID))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// forgetLearned drops the oldest counted mails beyond headerPriorsMaxLearned,
+// the caller must hold the lock.
+func forgetLearned() {
+	for len(priors.data.LearnedOrder) > headerPriorsMaxLearned {
+		delete(priors.data.LearnedMails, priors.data.LearnedOrder[0])
+		priors.data.LearnedOrder = priors.data.LearnedOrder[1:]
+	}
+}
+
+// learnSignals counts category for the signals of the mail with messageID.
+// Mails without a Message-ID are counted every time they are classified.
+func learnSignals(messageID string, signals []string, category string) {
+	if len(category) == 0 || len(signals) == 0 {
+		return
+	}
+
+	priors.Lock()
+	defer priors.Unlock()
+	loadPriors()
+
+	if len(messageID) > 0 {
+		key := learnedKey(messageID)
+		old, ok := priors.data.LearnedMails[key]
+		if ok && old.Category == category && reflect.DeepEqual(old.Signals, signals) {
+			return
+		}
+		if ok {
+			// the signals may have changed since, e.g. the Gmail category
+			for _, signal := range old.Signals {
+				if priors.data.Counts[signal][old.Category] > 0 {
+					priors.data.Counts[signal][old.Category]--
+				}
+			}
+		} else {
+			priors.data.LearnedOrder = append(priors.data.LearnedOrder, key)
+		}
+		priors.data.LearnedMails[key] = learnedMail{category, signals}
+		forgetLearned()
+	}
+	for _, signal := range signals {
+		counts, ok := priors.data.Counts[signal]
+		if !ok {
+			counts = map[string]int{}
+			priors.data.Counts[signal] = counts
+		}
+		counts[category]++
+	}
+
+	// the bulk job classifies many mails a second, write at most every few
+	// seconds
+	priors.dirty = true
+	if time.Since(priors.saved) > headerPriorsSaveDelay {
+		savePriors()
+	}
+}
+
+// flushPriors writes what was learned since the last save.
+func flushPriors() {
+	priors.Lock()
+	defer priors.Unlock()
+	savePriors()
+}
+
+// savePriors writes the priors if they changed, the caller must hold the lock.
+func savePriors() {
+	if !priors.dirty {
+		return
+	}
+	if err := saveJSON(headerPriorsFile, priors.data); err != nil {
+		log.Printf("Unable to save header priors: %v", err)
+		return
+	}
+	priors.dirty = false
+	priors.saved = time.Now()
+}
+
+// applyPriors shifts the text scores by what the signals say about the
+// categories. Each signal's prior is the smoothed share of each category
+// among the mails seen with it. The shift is the prior minus the uniform
+// prior, so a signal that says nothing changes nothing, and is scaled by
+// -header-prior-weight and by how much the signal has been seen.
+func applyPriors(results []ClassificationResult, signals []string) []ClassificationResult {
+	if *headerPriorWeight <= 0 || len(results) == 0 || len(signals) == 0 {
+		return results
+	}
+
+	priors.Lock()
+	loadPriors()
+	type signalPrior struct {
+		counts map[string]int
+		total  int
+	}
+	known := []signalPrior{}
+	for _, signal := range signals {
+		counts := priors.data.Counts[signal]
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		if total > 0 {
+			known = append(known, signalPrior{counts, total})
+		}
+	}
+	priors.Unlock()
+	if len(known) == 0 {
+		return results
+	}
+
+	// signals seen more often count more, and the shift is only as strong
+	// as the best known signal
+	weights, maxWeight := make([]float64, len(known)), 0.0
+	sum := 0.0
+	for i, p := range known {
+		weights[i] = float64(p.total) / float64(p.total+headerPriorStrength)
+		sum += weights[i]
+		if weights[i] > maxWeight {
+			maxWeight = weights[i]
+		}
+	}
+
+	k := float64(len(results))
+	combined := make([]ClassificationResult, len(results))
+	for i, result := range results {
+		shift := 0.0
+		for j, p := range known {
+			prior := (float64(p.counts[result.Category]) + 1) / (float64(p.total) + k)
+			shift += weights[j] * (prior - 1/k)
+		}
+		shift = shift / sum * maxWeight * *headerPriorWeight
+		combined[i] = ClassificationResult{Category: result.Category, Score: math.Max(0, result.Score+shift)}
+	}
+	sort.SliceStable(combined, func(i, j int) bool { return combined[i].Score > combined[j].Score })
+	return combined
+}
+
+// classifyMails classifies mails with the default options, see
+// classifyMailsWith.
+func classifyMails(mails []MailMessage) ([]ClassificationResult, error) {
+	results, _, err := classifyMailsWith(mails, defaultClassifyOptions())
+	return results, err
+}
+
+// classifyMailsWith classifies the text of mails and combines the scores with
+// what their header signals learned so far. The signals learn the top text
+// category, not the combined one, so the priors do not reinforce themselves,
+// and only with the default options. The scores of each message are only
+// returned in the message mode.
+func classifyMailsWith(mails []MailMessage, opts classifyOptions) ([]ClassificationResult, [][]ClassificationResult, error) {
+	results, perMessage, err := textScores(mails, opts)
+	if err != nil || len(results) == 0 {
+		return results, perMessage, err
+	}
+
+	signals := mailSignals(mails)
+	combined := applyPriors(results, signals)
+	if opts == defaultClassifyOptions() {
+		learnSignals(mails[0].MessageID, signals, results[0].Category)
+	}
+	return combined, perMessage, nil
+}
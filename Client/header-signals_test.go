@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// usePriors starts the test with no header priors learned.
+func usePriors(t *testing.T) {
+	inTempDir(t)
+	priors.Lock()
+	defer priors.Unlock()
+	priors.loaded = false
+	priors.dirty = false
+	t.Cleanup(func() {
+		priors.Lock()
+		defer priors.Unlock()
+		priors.loaded = false
+		priors.dirty = false
+	})
+}
+
+func TestLearnSignalsCountsMailsOnce(t *testing.T) {
+	usePriors(t)
+	signals := []string{"domain:example.com"}
+
+	learnSignals("<a@example.com>", signals, "Physics")
+	learnSignals("<a@example.com>", signals, "Physics")
+	learnSignals("<b@example.com>", signals, "Physics")
+	learnSignals("<a@example.com>", signals, "Sports")
+	learnSignals("", signals, "Sports")
+	learnSignals("", signals, "Sports")
+
+	counts := priors.data.Counts["domain:example.com"]
+	if counts["Physics"] != 1 || counts["Sports"] != 3 {
+		t.Errorf("counts %v, want Physics 1 and Sports 3", counts)
+	}
+	if len(priors.data.LearnedMails) != 2 || len(priors.data.LearnedOrder) != 2 {
+		t.Errorf("learned %v in the order %v, want the two Message-IDs", priors.data.LearnedMails, priors.data.LearnedOrder)
+	}
+}
+
+func TestLearnSignalsForgetsOldestMails(t *testing.T) {
+	usePriors(t)
+	signals := []string{"bulk"}
+
+	for i := 0; i < headerPriorsMaxLearned+10; i++ {
+		learnSignals(fmt.Sprintf("<%d@example.com>", i), signals, "News")
+	}
+	if len(priors.data.LearnedMails) != headerPriorsMaxLearned || len(priors.data.LearnedOrder) != headerPriorsMaxLearned {
+		t.Fatalf("%d mails learned in an order of %d, want %d", len(priors.data.LearnedMails), len(priors.data.LearnedOrder), headerPriorsMaxLearned)
+	}
+	if _, ok := priors.data.LearnedMails[learnedKey("<0@example.com>")]; ok {
+		t.Error("the oldest mail is still learned")
+	}
+	if _, ok := priors.data.LearnedMails[learnedKey(fmt.Sprintf("<%d@example.com>", headerPriorsMaxLearned+9))]; !ok {
+		t.Error("the newest mail is not learned")
+	}
+
+	// the file is read back with the same mails
+	flushPriors()
+	priors.Lock()
+	priors.loaded = false
+	loadPriors()
+	learned, order := len(priors.data.LearnedMails), len(priors.data.LearnedOrder)
+	priors.Unlock()
+	if learned != headerPriorsMaxLearned || order != headerPriorsMaxLearned {
+		t.Errorf("%d mails learned in an order of %d after loading", learned, order)
+	}
+}
+
+func TestClassifyMailsWithOtherOptionsLearnsNothing(t *testing.T) {
+	usePriors(t)
+	useFakeClassifier(t, "Physics")
+	mails := []MailMessage{{MessageID: "<a@example.com>", From: "jane@example.com", Body: "quarks"}}
+
+	opts := defaultClassifyOptions()
+	opts.Combine = combineMax
+	if opts == defaultClassifyOptions() {
+		opts.Combine = combineLength
+	}
+	if _, _, err := classifyMailsWith(mails, opts); err != nil {
+		t.Fatal(err)
+	}
+	if counts := priors.data.Counts["domain:example.com"]; len(counts) > 0 {
+		t.Errorf("viewing with other options learned %v", counts)
+	}
+
+	if _, err := classifyMails(mails); err != nil {
+		t.Fatal(err)
+	}
+	if counts := priors.data.Counts["domain:example.com"]; counts["Physics"] != 1 {
+		t.Errorf("classifying learned %v, want Physics once", counts)
+	}
+}
+
+func TestLearnSignalsMovesCountsOfChangedSignals(t *testing.T) {
+	usePriors(t)
+
+	learnSignals("<a@example.com>", []string{"domain:example.com", "gmail:CATEGORY_UPDATES"}, "Physics")
+	learnSignals("<a@example.com>", []string{"domain:example.com", "gmail:CATEGORY_PROMOTIONS"}, "Physics")
+
+	want := map[string]map[string]int{
+		"domain:example.com":        {"Physics": 1},
+		"gmail:CATEGORY_UPDATES":    {"Physics": 0},
+		"gmail:CATEGORY_PROMOTIONS": {"Physics": 1},
+	}
+	for signal, counts := range want {
+		if got := priors.data.Counts[signal]; got["Physics"] != counts["Physics"] {
+			t.Errorf("%s counts %v, want %v", signal, got, counts)
+		}
+	}
+
+	learnSignals("<a@example.com>", []string{"domain:example.com"}, "Sports")
+	if got := priors.data.Counts["gmail:CATEGORY_PROMOTIONS"]; got["Physics"] != 0 {
+		t.Errorf("relearning left %v on the old signal", got)
+	}
+	if got := priors.data.Counts["domain:example.com"]; got["Physics"] != 0 || got["Sports"] != 1 {
+		t.Errorf("domain counts %v, want Sports once", got)
+	}
+}
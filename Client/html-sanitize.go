@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// sanitizeAllowedTags are the elements kept when showing an HTML mail, with
+// the attributes they may keep. Everything else is dropped but its text is
+// kept, except for the elements in sanitizeDroppedTags.
+var sanitizeAllowedTags = map[atom.Atom][]string{
+	atom.A: {"href", "title"}, atom.B: nil, atom.Blockquote: nil, atom.Br: nil,
+	atom.Code: nil, atom.Div: nil, atom.Em: nil, atom.H1: nil, atom.H2: nil,
+	atom.H3: nil, atom.H4: nil, atom.H5: nil, atom.H6: nil, atom.Hr: nil,
+	atom.I: nil, atom.Li: nil, atom.Ol: nil, atom.P: nil, atom.Pre: nil,
+	atom.S: nil, atom.Small: nil, atom.Span: nil, atom.Strong: nil,
+	atom.Sub: nil, atom.Sup: nil, atom.Table: nil, atom.Tbody: nil,
+	atom.Td: {"colspan", "rowspan"}, atom.Tfoot: nil,
+	atom.Th: {"colspan", "rowspan"}, atom.Thead: nil, atom.Tr: nil,
+	atom.U: nil, atom.Ul: nil,
+}
+
+// sanitizeDroppedTags are dropped together with their content.
+var sanitizeDroppedTags = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Title: true,
+	atom.Iframe: true, atom.Object: true, atom.Embed: true, atom.Noscript: true,
+	atom.Template: true, atom.Svg: true, atom.Math: true, atom.Form: true,
+	atom.Textarea: true, atom.Select: true,
+}
+
+// htmlVoidElements never have content or an end tag, a start tag of one is
+// the whole element even without "/>".
+var htmlVoidElements = map[atom.Atom]bool{
+	atom.Area: true, atom.Base: true, atom.Br: true, atom.Col: true,
+	atom.Embed: true, atom.Hr: true, atom.Img: true, atom.Input: true,
+	atom.Keygen: true, atom.Link: true, atom.Meta: true, atom.Param: true,
+	atom.Source: true, atom.Track: true, atom.Wbr: true,
+}
+
+// htmlHeadElements are the elements of the head of a document.
+var htmlHeadElements = map[atom.Atom]bool{
+	atom.Base: true, atom.Link: true, atom.Meta: true, atom.Script: true,
+	atom.Style: true, atom.Title: true, atom.Noscript: true, atom.Template: true,
+}
+
+// htmlHead follows whether the tokens are in the head of a document, which
+// is never shown. The end tag of the head is optional, like browsers the head
+// also ends with any element or text that belongs in the body.
+type htmlHead struct {
+	in  bool
+	raw atom.Atom // open element of the head whose content is text
+}
+
+// skip reports whether tok belongs to the head.
+func (h *htmlHead) skip(tt xhtml.TokenType, tok xhtml.Token) bool {
+	if tok.DataAtom == atom.Head && tt != xhtml.TextToken {
+		h.in, h.raw = tt == xhtml.StartTagToken, 0
+		return true
+	}
+	if !h.in {
+		return false
+	}
+	switch tt {
+	case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+		if !htmlHeadElements[tok.DataAtom] {
+			h.in = false
+			return false
+		}
+		if tt == xhtml.StartTagToken && (tok.DataAtom == atom.Title || tok.DataAtom == atom.Style || tok.DataAtom == atom.Script) {
+			h.raw = tok.DataAtom
+		}
+	case xhtml.EndTagToken:
+		if tok.DataAtom == h.raw {
+			h.raw = 0
+		}
+	case xhtml.TextToken:
+		if h.raw == 0 && len(strings.TrimSpace(tok.Data)) > 0 {
+			h.in = false
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeHTML turns the HTML of a mail into markup that is safe to embed in
+// our pages: only simple formatting is kept, no scripts, styles, forms or
+// remote images, and links only to http, https and mailto URLs. Images are
+// replaced by their alt text so opening a mail does not tell the sender.
+// Elements are always closed, so the mail cannot break the page around it.
+func sanitizeHTML(in string) string {
+	var out bytes.Buffer
+	z := xhtml.NewTokenizer(strings.NewReader(in))
+	dropDepth := 0 // > 0 inside an element dropped with its content
+	open := []atom.Atom{}
+	head := &htmlHead{}
+
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			for i := len(open) - 1; i >= 0; i-- {
+				out.WriteString("</" + open[i].String() + ">")
+			}
+			return out.String()
+		}
+		tok := z.Token()
+		if head.skip(tt, tok) {
+			continue
+		}
+
+		switch tt {
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			if sanitizeDroppedTags[tok.DataAtom] {
+				if tt == xhtml.StartTagToken && !htmlVoidElements[tok.DataAtom] {
+					dropDepth++
+				}
+				continue
+			}
+			if dropDepth > 0 {
+				continue
+			}
+			if tok.DataAtom == atom.Img {
+				for _, attr := range tok.Attr {
+					if attr.Key == "alt" && len(attr.Val) > 0 {
+						out.WriteString("[" + html.EscapeString(attr.Val) + "]")
+					}
+				}
+				continue
+			}
+			allowed, ok := sanitizeAllowedTags[tok.DataAtom]
+			if !ok {
+				continue
+			}
+			out.WriteString("<" + tok.DataAtom.String())
+			for _, attr := range tok.Attr {
+				if !containsString(allowed, attr.Key) {
+					continue
+				}
+				if attr.Key == "href" && !safeLink(attr.Val) {
+					continue
+				}
+				out.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+			}
+			if tok.DataAtom == atom.A {
+				out.WriteString(` rel="noopener noreferrer" target="_blank"`)
+			}
+			out.WriteString(">")
+			if !htmlVoidElements[tok.DataAtom] {
+				open = append(open, tok.DataAtom)
+			}
+		case xhtml.EndTagToken:
+			if sanitizeDroppedTags[tok.DataAtom] {
+				if dropDepth > 0 && !htmlVoidElements[tok.DataAtom] {
+					dropDepth--
+				}
+				continue
+			}
+			if dropDepth > 0 {
+				continue
+			}
+			// close everything up to the matching element, end tags
+			// without one are dropped
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tok.DataAtom {
+					for j := len(open) - 1; j >= i; j-- {
+						out.WriteString("</" + open[j].String() + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+		case xhtml.TextToken:
+			if dropDepth == 0 {
+				out.WriteString(html.EscapeString(tok.Data))
+			}
+		}
+	}
+}
+
+// safeLink reports whether a link may be kept, javascript: and data: URLs
+// are not.
+func safeLink(href string) bool {
+	href = strings.ToLower(strings.TrimSpace(href))
+	return strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "mailto:")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"formatting", `<p class="x" onclick="steal()">Hello <b>world</b></p>`, `<p>Hello <b>world</b></p>`},
+		{"script", `<p>a</p><script>alert(1)</script><p>b</p>`, `<p>a</p><p>b</p>`},
+		{"style in head", `<html><head><style>p{}</style></head><body><p>a</p></body></html>`, `<p>a</p>`},
+		{"head without end tag", `<html><head><meta charset="utf-8"><title>x</title><body><p>Hello there</p></body></html>`, `<p>Hello there</p>`},
+		{"head ended by content", `<head><title>x</title><style>p{}</style><p>Hello</p>`, `<p>Hello</p>`},
+		{"head ended by text", `<head><title>x</title>Hello`, `Hello`},
+		{"embed without end tag", `<p>Hello</p><embed src="x.swf"><p>Your invoice</p>`, `<p>Hello</p><p>Your invoice</p>`},
+		{"embed with end tag", `<p>Hello</p><embed src="x.swf"></embed><p>Your invoice</p>`, `<p>Hello</p><p>Your invoice</p>`},
+		{"self-closed embed", `<embed src="x.swf"/><p>Your invoice</p>`, `<p>Your invoice</p>`},
+		{"iframe content", `<iframe src="x">fallback</iframe><p>a</p>`, `<p>a</p>`},
+		{"links", `<a href="javascript:x()">bad</a> <a href="https://ok.example">ok</a>`,
+			`<a rel="noopener noreferrer" target="_blank">bad</a> <a href="https://ok.example" rel="noopener noreferrer" target="_blank">ok</a>`},
+		{"image alt", `<img src="http://track.example/p.gif" alt="logo">text`, `[logo]text`},
+		{"unclosed", `<div><p>a`, `<div><p>a</p></div>`},
+		{"stray end tag", `a</div></p>b`, `ab`},
+		{"line break", `a<br>b<hr>`, `a<br>b<hr>`},
+		{"escaped text", `1 &lt; 2 &amp; <b>"x"</b>`, `1 &lt; 2 &amp; <b>&#34;x&#34;</b>`},
+	}
+	for _, tt := range tests {
+		if got := sanitizeHTML(tt.in); got != tt.want {
+			t.Errorf("%s: sanitizeHTML(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlSkippedTags are not visible, their content is not part of the text.
+var htmlSkippedTags = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Title: true,
+	atom.Noscript: true, atom.Template: true, atom.Svg: true, atom.Math: true,
+	atom.Iframe: true, atom.Object: true, atom.Embed: true, atom.Select: true,
+}
+
+// htmlBreaks is the number of line breaks around block elements: 2 for
+// paragraphs, 1 for lines.
+var htmlBreaks = map[atom.Atom]int{
+	atom.P: 2, atom.H1: 2, atom.H2: 2, atom.H3: 2, atom.H4: 2, atom.H5: 2,
+	atom.H6: 2, atom.Blockquote: 2, atom.Ul: 2, atom.Ol: 2, atom.Dl: 2,
+	atom.Table: 2, atom.Pre: 2, atom.Hr: 2, atom.Address: 2, atom.Figure: 2,
+	atom.Div: 1, atom.Li: 1, atom.Tr: 1, atom.Dt: 1, atom.Dd: 1,
+	atom.Section: 1, atom.Article: 1, atom.Header: 1, atom.Footer: 1,
+	atom.Nav: 1, atom.Aside: 1, atom.Main: 1, atom.Center: 1, atom.Form: 1,
+	atom.Caption: 1, atom.Figcaption: 1,
+}
+
+// htmlText builds the text of an HTML document. Line breaks and spaces are
+// only written when the next text comes, so blocks never leave runs of empty
+// lines behind.
+type htmlText struct {
+	out    strings.Builder
+	breaks int  // line breaks before the next text
+	space  bool // a space before the next text
+	quote  int  // depth of blockquotes, their lines are prefixed with "> "
+	pre    int  // depth of pre elements, their white space is kept
+}
+
+func (t *htmlText) lineBreak(n int) {
+	if n > t.breaks {
+		t.breaks = n
+	}
+}
+
+func (t *htmlText) write(s string) {
+	trailing := false
+	if t.pre == 0 {
+		if strings.TrimLeftFunc(s, unicode.IsSpace) != s {
+			t.space = true
+		}
+		trailing = strings.TrimRightFunc(s, unicode.IsSpace) != s
+		s = strings.Join(strings.Fields(s), " ")
+	}
+	if len(s) == 0 {
+		return
+	}
+
+	newLine := t.out.Len() == 0 || t.breaks > 0
+	if t.out.Len() > 0 {
+		if t.breaks > 0 {
+			t.out.WriteString(strings.Repeat("\n", t.breaks))
+		} else if t.space {
+			t.out.WriteString(" ")
+		}
+	}
+	if newLine {
+		t.out.WriteString(strings.Repeat("> ", t.quote))
+	}
+	t.out.WriteString(s)
+	t.breaks, t.space = 0, trailing
+}
+
+// htmlToText converts the HTML of a mail to the text a reader sees:
+// scripts, styles and other invisible elements are dropped, paragraphs, list
+// items and table rows keep their line breaks and quoted replies are marked
+// with "> " like in plain text mails. With linkDomains the domain of a link
+// follows its text, e.g. "Track your order (shop.example.com)".
+func htmlToText(in string, linkDomains bool) string {
+	t := &htmlText{}
+	z := xhtml.NewTokenizer(strings.NewReader(in))
+	skipDepth := 0   // > 0 inside an element that is not visible
+	lists := []int{} // number of the next item of each open list, 0 for ul
+	linkDomain := "" // domain of the open link
+	linkStart := -1  // length of the text when the open link started
+	head := &htmlHead{}
+
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			return strings.TrimSpace(t.out.String())
+		}
+		tok := z.Token()
+		if head.skip(tt, tok) {
+			continue
+		}
+
+		switch tt {
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			if htmlSkippedTags[tok.DataAtom] {
+				if tt == xhtml.StartTagToken && !htmlVoidElements[tok.DataAtom] {
+					skipDepth++
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			t.lineBreak(htmlBreaks[tok.DataAtom])
+
+			switch tok.DataAtom {
+			case atom.Br:
+				if t.breaks < 2 {
+					t.breaks++
+				}
+			case atom.Td, atom.Th:
+				t.space = true
+			case atom.Img:
+				for _, attr := range tok.Attr {
+					if attr.Key == "alt" {
+						t.space = true
+						t.write(attr.Val)
+						t.space = true
+					}
+				}
+			case atom.Ul:
+				lists = append(lists, 0)
+			case atom.Ol:
+				lists = append(lists, 1)
+			case atom.Li:
+				if n := len(lists); n > 0 && lists[n-1] > 0 {
+					t.write(strconv.Itoa(lists[n-1]) + ".")
+					lists[n-1]++
+				} else {
+					t.write("-")
+				}
+				t.space = true
+			case atom.Blockquote:
+				t.quote++
+			case atom.Pre:
+				t.pre++
+			case atom.A:
+				linkDomain, linkStart = "", t.out.Len()
+				for _, attr := range tok.Attr {
+					if attr.Key == "href" {
+						linkDomain = hrefDomain(attr.Val)
+					}
+				}
+			}
+		case xhtml.EndTagToken:
+			if htmlSkippedTags[tok.DataAtom] {
+				if skipDepth > 0 && !htmlVoidElements[tok.DataAtom] {
+					skipDepth--
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			t.lineBreak(htmlBreaks[tok.DataAtom])
+
+			switch tok.DataAtom {
+			case atom.Ul, atom.Ol:
+				if len(lists) > 0 {
+					lists = lists[:len(lists)-1]
+				}
+			case atom.Blockquote:
+				if t.quote > 0 {
+					t.quote--
+				}
+			case atom.Pre:
+				if t.pre > 0 {
+					t.pre--
+				}
+			case atom.A:
+				// only links with text, and not if the text already is
+				// the address
+				text := t.out.String()
+				if linkDomains && len(linkDomain) > 0 && linkStart >= 0 && t.out.Len() > linkStart &&
+					!strings.Contains(strings.ToLower(text[linkStart:]), linkDomain) {
+					t.space = true
+					t.write("(" + linkDomain + ")")
+				}
+				linkDomain, linkStart = "", -1
+			}
+		case xhtml.TextToken:
+			if skipDepth == 0 {
+				t.write(tok.Data)
+			}
+		}
+	}
+}
+
+// hrefDomain returns the host of an http or https link without "www.".
+func hrefDomain(href string) string {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          string
+		linkDomains bool
+		want        string
+	}{
+		{"paragraphs", `<p>Hello</p><p>world</p>`, false, "Hello\n\nworld"},
+		{"inline", `Hello <b>big</b>   <i>world</i>`, false, "Hello big world"},
+		{"invisible", `<head><title>t</title><style>p{}</style></head><p>a</p><script>x()</script>`, false, "a"},
+		{"head without end tag", `<html><head><meta charset="utf-8"><title>x</title><body><p>Hello there</p></body></html>`, false, "Hello there"},
+		{"head ended by content", `<head><title>x</title><div>Hello</div>`, false, "Hello"},
+		{"embed without end tag", `<p>Hello</p><embed src="x.swf"><p>Your invoice</p>`, false, "Hello\n\nYour invoice"},
+		{"embed with end tag", `<p>Hello</p><embed src="x.swf"></embed><p>Your invoice</p>`, false, "Hello\n\nYour invoice"},
+		{"lists", `<ul><li>one</li><li>two</li></ul><ol><li>first</li><li>second</li></ol>`, false, "- one\n- two\n\n1. first\n2. second"},
+		{"table rows", `<table><tr><td>a</td><td>b</td></tr><tr><td>c</td></tr></table>`, false, "a b\nc"},
+		{"line breaks", `a<br>b<br><br><br>c`, false, "a\nb\n\nc"},
+		{"blockquote", `<p>reply</p><blockquote><p>quoted</p></blockquote>`, false, "reply\n\n> quoted"},
+		{"pre", `<pre>a  b
+c</pre>`, false, "a  b\nc"},
+		{"image alt", `Logo<img src="x" alt="Shop">here`, false, "Logo Shop here"},
+		{"link", `<a href="https://www.shop.example/track">Track your order</a>`, false, "Track your order"},
+		{"link domain", `<a href="https://www.shop.example/track">Track your order</a>`, true, "Track your order (shop.example)"},
+		{"link domain in text", `<a href="https://shop.example/">shop.example</a>`, true, "shop.example"},
+		{"mailto link", `<a href="mailto:a@b.example">write us</a>`, true, "write us"},
+		{"entities", `1&nbsp;&lt;&nbsp;2`, false, "1 < 2"},
+	}
+	for _, tt := range tests {
+		if got := htmlToText(tt.in, tt.linkDomains); got != tt.want {
+			t.Errorf("%s: htmlToText(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
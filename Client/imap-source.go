@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	imapStateFile = "imap-state.json"
+	imapFetchSize = 50
+	imapPageSize  = 30
+)
+
+// IMAPAccount holds the connection settings of an IMAP mailbox.
+type IMAPAccount struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	// TLS connects with implicit TLS (usually port 993). Otherwise STARTTLS
+	// is required, unless the server is on this machine or -imap-insecure
+	// is set.
+	TLS bool
+}
+
+// key identifies the account in the stored state, the password is left out.
+func (acc IMAPAccount) key() string {
+	return acc.Username + "@" + acc.Addr
+}
+
+// dial connects and logs in. The password is never sent in plain text over
+// the network, see plainLoginAllowed.
+func (acc IMAPAccount) dial() (*client.Client, error) {
+	var c *client.Client
+	var err error
+	if acc.TLS {
+		c, err = client.DialTLS(acc.Addr, nil)
+	} else {
+		c, err = client.Dial(acc.Addr)
+		if err == nil {
+			var startTLS bool
+			if startTLS, err = c.SupportStartTLS(); err == nil {
+				if startTLS {
+					host, _, _ := net.SplitHostPort(acc.Addr)
+					err = c.StartTLS(&tls.Config{ServerName: host})
+				} else if !plainLoginAllowed(acc.Addr) {
+					err = fmt.Errorf("%s supports neither TLS nor STARTTLS, the password would be sent in plain text (start with -imap-insecure to allow it)", acc.Addr)
+				}
+			}
+		}
+	}
+	if err != nil {
+		if c != nil {
+			c.Logout()
+		}
+		return nil, err
+	}
+
+	if err := c.Login(acc.Username, acc.Password); err != nil {
+		c.Logout()
+		return nil, err
+	}
+	return c, nil
+}
+
+// plainLoginAllowed reports whether logging in without TLS is acceptable:
+// for servers on this machine, e.g. a local test server or a bridge, or if
+// -imap-insecure is set.
+func plainLoginAllowed(addr string) bool {
+	if *imapInsecure {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listIMAPFolders returns the names of all selectable folders.
+func listIMAPFolders(acc IMAPAccount) ([]string, error) {
+	c, err := acc.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout()
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+
+	folders := []string{}
+	for m := range mailboxes {
+		selectable := true
+		for _, attr := range m.Attributes {
+			if attr == imap.NoSelectAttr {
+				selectable = false
+			}
+		}
+		if selectable {
+			folders = append(folders, m.Name)
+		}
+	}
+	sort.Strings(folders)
+	return folders, <-done
+}
+
+// imapFolderState remembers how far a folder has been classified. UIDs are
+// only meaningful as long as the UIDVALIDITY of the folder stays the same.
+type imapFolderState struct {
+	UIDValidity uint32
+	LastUID     uint32
+}
+
+var imapState = struct {
+	sync.Mutex
+	folders map[string]imapFolderState // account key + "/" + folder -> state
+}{folders: map[string]imapFolderState{}}
+
+func loadIMAPState() {
+	imapState.Lock()
+	defer imapState.Unlock()
+	if err := loadJSON(imapStateFile, &imapState.folders); err != nil {
+		log.Printf("Unable to load IMAP state: %v", err)
+	}
+}
+
+func imapFolderStateOf(acc IMAPAccount, folder string) imapFolderState {
+	imapState.Lock()
+	defer imapState.Unlock()
+	return imapState.folders[acc.key()+"/"+folder]
+}
+
+func saveIMAPFolderState(acc IMAPAccount, folder string, state imapFolderState) {
+	imapState.Lock()
+	defer imapState.Unlock()
+	imapState.folders[acc.key()+"/"+folder] = state
+	if err := saveJSON(imapStateFile, imapState.folders); err != nil {
+		log.Printf("Unable to save IMAP state: %v", err)
+	}
+}
+
+// imapSource reads the messages of an IMAP folder with a UID above sinceUID.
+// The message ID is the UID. After Messages returned, uidValidity holds the
+// folder's UIDVALIDITY; if it differs from the one sinceUID belongs to, all
+// messages are read.
+type imapSource struct {
+	account     IMAPAccount
+	folder      string
+	sinceUID    uint32
+	uidValidity uint32
+}
+
+func (s *imapSource) Name() string { return "IMAP " + s.account.key() + "/" + s.folder }
+
+func (s *imapSource) Messages(fn func(MailMessage) error) error {
+	c, err := s.account.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	status, err := c.Select(s.folder, true)
+	if err != nil {
+		return err
+	}
+	if status.UidValidity != s.uidValidity {
+		s.sinceUID = 0
+		s.uidValidity = status.UidValidity
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(s.sinceUID+1, 0)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+
+	// "n:*" always matches the last message, even if its UID is below n
+	newUIDs := []uint32{}
+	for _, uid := range uids {
+		if uid > s.sinceUID {
+			newUIDs = append(newUIDs, uid)
+		}
+	}
+	sort.Slice(newUIDs, func(i, j int) bool { return newUIDs[i] < newUIDs[j] })
+
+	for start := 0; start < len(newUIDs); start += imapFetchSize {
+		end := start + imapFetchSize
+		if end > len(newUIDs) {
+			end = len(newUIDs)
+		}
+
+		mails, err := fetchIMAPMessages(c, newUIDs[start:end])
+		if err != nil {
+			return err
+		}
+		for _, msg := range mails {
+			if err := fn(msg); err != nil {
+				return ignoreStop(err)
+			}
+		}
+	}
+	return nil
+}
+
+// fetchIMAPMessages fetches and parses the messages with the given UIDs from
+// the selected folder, ordered by UID.
+func fetchIMAPMessages(c *client.Client, uids []uint32) ([]MailMessage, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	section := &imap.BodySectionName{Peek: true}
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, messages)
+	}()
+
+	byUID := map[uint32]MailMessage{}
+	for m := range messages {
+		body := m.GetBody(section)
+		if body == nil {
+			continue
+		}
+		msg, err := parseRawMessage(body, strconv.FormatUint(uint64(m.Uid), 10))
+		if err != nil {
+			log.Printf("Skipping IMAP message %d: %v", m.Uid, err)
+			continue
+		}
+		byUID[m.Uid] = msg
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	mails := []MailMessage{}
+	for _, uid := range uids {
+		if msg, ok := byUID[uid]; ok {
+			mails = append(mails, msg)
+		}
+	}
+	return mails, nil
+}
+
+// fetchIMAPMessage fetches a single message by UID.
+func fetchIMAPMessage(acc IMAPAccount, folder string, uid uint32) (MailMessage, error) {
+	c, err := acc.dial()
+	if err != nil {
+		return MailMessage{}, err
+	}
+	defer c.Logout()
+
+	if _, err := c.Select(folder, true); err != nil {
+		return MailMessage{}, err
+	}
+	mails, err := fetchIMAPMessages(c, []uint32{uid})
+	if err != nil {
+		return MailMessage{}, err
+	}
+	if len(mails) == 0 {
+		return MailMessage{}, fmt.Errorf("no message with UID %d in %s", uid, folder)
+	}
+	return mails[0], nil
+}
+
+// classifyIMAPFolder classifies up to limit messages that arrived in folder
+// since the last run and remembers the last UID it got to.
+func classifyIMAPFolder(acc IMAPAccount, folder string, limit int, fromStart bool) ([]LocalMail, bool, error) {
+	state := imapFolderStateOf(acc, folder)
+	src := &imapSource{account: acc, folder: folder, sinceUID: state.LastUID, uidValidity: state.UIDValidity}
+	if fromStart {
+		src.sinceUID = 0
+	}
+
+	mails, more, err := readMailSource(src, 0, limit)
+	if err != nil {
+		return nil, false, err
+	}
+
+	state = imapFolderState{UIDValidity: src.uidValidity, LastUID: src.sinceUID}
+	classified := []LocalMail{}
+	for _, msg := range mails {
+		results, err := classifyMails([]MailMessage{msg})
+		if err != nil {
+			// remember the messages done so far, the next run continues here
+			saveIMAPFolderState(acc, folder, state)
+			return classified, true, err
+		}
+		classified = append(classified, LocalMail{msg, results})
+		uid, _ := strconv.ParseUint(msg.ID, 10, 32)
+		state.LastUID = uint32(uid)
+	}
+	saveIMAPFolderState(acc, folder, state)
+	return classified, more, nil
+}
+
+// imapSession is the account entered in the web UI. The password is only
+// kept in memory.
+var imapSession = struct {
+	sync.Mutex
+	account *IMAPAccount
+}{}
+
+func webIMAP(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "POST" && len(r.FormValue("addr")) > 0 {
+		imapSession.Lock()
+		imapSession.account = &IMAPAccount{
+			Addr:     r.FormValue("addr"),
+			Username: r.FormValue("username"),
+			Password: r.FormValue("password"),
+			TLS:      len(r.FormValue("tls")) > 0,
+		}
+		imapSession.Unlock()
+	}
+
+	imapSession.Lock()
+	account := imapSession.account
+	imapSession.Unlock()
+
+	data := struct {
+		Account *IMAPAccount
+		Folder  string
+		Folders []string
+		State   imapFolderState
+		Mails   []LocalMail
+		More    bool
+		Error   string
+	}{Account: account, Folder: r.FormValue("folder")}
+
+	var err error
+	if account != nil {
+		if len(data.Folder) == 0 {
+			data.Folders, err = listIMAPFolders(*account)
+		} else if uid, _ := strconv.ParseUint(r.FormValue("uid"), 10, 32); uid > 0 {
+			var msg MailMessage
+			msg, err = fetchIMAPMessage(*account, data.Folder, uint32(uid))
+			if err == nil {
+				var results []ClassificationResult
+				if results, err = classifyMails([]MailMessage{msg}); err == nil {
+					data.Mails = []LocalMail{{msg, results}}
+				}
+			}
+		} else if r.Method == "POST" {
+			data.Mails, data.More, err = classifyIMAPFolder(*account, data.Folder, imapPageSize, len(r.FormValue("fromStart")) > 0)
+		}
+		data.State = imapFolderStateOf(*account, data.Folder)
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	return renderPage(w, "imap.html", "IMAP", "", data)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// startIMAPServer runs an in-process IMAP server without TLS on a loopback
+// port. It has the user "username" with the password "password" and a
+// message with UID 6 in INBOX.
+func startIMAPServer(t *testing.T) IMAPAccount {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return IMAPAccount{Addr: l.Addr().String(), Username: "username", Password: "password"}
+}
+
+// useFakeClassifier answers every classification with category and
+// returns the texts it was asked to classify.
+func useFakeClassifier(t *testing.T, category string) *[]string {
+	texts := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		texts = append(texts, string(b))
+		fmt.Fprintf(w, `[{"first":%q,"second":0.9},{"first":"Other","second":0.1}]`, category)
+	}))
+	t.Cleanup(ts.Close)
+	url := classifierURL
+	classifierURL = ts.URL
+	t.Cleanup(func() { classifierURL = url })
+	return &texts
+}
+
+// inTempDir runs the test in a new working directory, for the state files
+// written next to the binary.
+func inTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+func appendIMAPMessage(t *testing.T, acc IMAPAccount, subject, body string) {
+	c, err := acc.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+	msg := bytes.NewBufferString("From: sender@example.org\r\nTo: username@example.org\r\nSubject: " + subject +
+		"\r\nDate: Mon, 2 Jan 2006 15:04:05 +0000\r\nContent-Type: text/plain\r\n\r\n" + body)
+	if err := c.Append("INBOX", nil, time.Now(), msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mailIDs(mails []LocalMail) []string {
+	ids := []string{}
+	for _, mail := range mails {
+		ids = append(ids, mail.ID)
+	}
+	return ids
+}
+
+func TestIMAPFolders(t *testing.T) {
+	acc := startIMAPServer(t)
+	folders, err := listIMAPFolders(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"INBOX"}; !reflect.DeepEqual(folders, want) {
+		t.Errorf("folders %v, want %v", folders, want)
+	}
+
+	acc.Password = "wrong"
+	if _, err := listIMAPFolders(acc); err == nil {
+		t.Error("login with a wrong password succeeded")
+	}
+}
+
+func TestClassifyIMAPFolderIncremental(t *testing.T) {
+	inTempDir(t)
+	acc := startIMAPServer(t)
+	texts := useFakeClassifier(t, "Physics")
+
+	mails, more, err := classifyIMAPFolder(acc, "INBOX", imapPageSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 || more {
+		t.Fatalf("first run got %v, more %v, want the message in INBOX", mailIDs(mails), more)
+	}
+	if mails[0].Subject != "A little message, just for you" || mails[0].Results[0].Category != "Physics" {
+		t.Errorf("first run got %+v", mails[0])
+	}
+	if len(*texts) != 1 || !bytes.Contains([]byte((*texts)[0]), []byte("Hi there")) {
+		t.Errorf("classifier was asked %q", *texts)
+	}
+	if state := imapFolderStateOf(acc, "INBOX"); state.LastUID != 6 || state.UIDValidity == 0 {
+		t.Errorf("state after the first run %+v", state)
+	}
+
+	appendIMAPMessage(t, acc, "Second", "a new message")
+	mails, _, err = classifyIMAPFolder(acc, "INBOX", imapPageSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 || mails[0].Subject != "Second" {
+		t.Fatalf("second run got %v, want only the new message", mailIDs(mails))
+	}
+	newUID := mails[0].ID
+
+	mails, _, err = classifyIMAPFolder(acc, "INBOX", imapPageSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 0 {
+		t.Errorf("run without new mail got %v", mailIDs(mails))
+	}
+
+	mails, _, err = classifyIMAPFolder(acc, "INBOX", imapPageSize, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"6", newUID}; !reflect.DeepEqual(mailIDs(mails), want) {
+		t.Errorf("run from the start got %v, want %v", mailIDs(mails), want)
+	}
+}
+
+func TestClassifyIMAPFolderClassifierDown(t *testing.T) {
+	inTempDir(t)
+	acc := startIMAPServer(t)
+	url := classifierURL
+	classifierURL = "http://127.0.0.1:1/classify"
+	defer func() { classifierURL = url }()
+
+	if _, _, err := classifyIMAPFolder(acc, "INBOX", imapPageSize, false); !classifierUnavailable(err) {
+		t.Fatalf("error %v, want the classifier to be unavailable", err)
+	}
+	if state := imapFolderStateOf(acc, "INBOX"); state.LastUID != 0 {
+		t.Errorf("LastUID advanced to %d without classifying", state.LastUID)
+	}
+}
+
+func TestPlainLoginAllowed(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:143", true},
+		{"[::1]:143", true},
+		{"localhost:1143", true},
+		{"imap.example.com:143", false},
+		{"192.168.1.10:143", false},
+		{"imap.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := plainLoginAllowed(tt.addr); got != tt.want {
+			t.Errorf("plainLoginAllowed(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	insecure := *imapInsecure
+	*imapInsecure = true
+	defer func() { *imapInsecure = insecure }()
+	if !plainLoginAllowed("imap.example.com:143") {
+		t.Error("-imap-insecure does not allow plain text logins")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const localMailPageSize = 30
+
+// LocalMail is a message from a local archive together with its
+// classification.
+type LocalMail struct {
+	MailMessage
+	Results []ClassificationResult
+}
+
+// classifyMailSource classifies every message of a local archive and prints
+// one tab separated line per message: ID, top category, score and subject.
+func classifyMailSource(kind, path string) error {
+	src, err := openMailSource(kind, path)
+	if err != nil {
+		return err
+	}
+
+	return src.Messages(func(msg MailMessage) error {
+		results, err := classifyMails([]MailMessage{msg})
+		if err != nil {
+			return err
+		}
+		category, score := "", 0.0
+		if len(results) > 0 {
+			category, score = results[0].Category, results[0].Score
+		}
+		fmt.Printf("%s\t%s\t%g\t%s\n", msg.ID, category, score, msg.Subject)
+		return nil
+	})
+}
+
+func webLocalMail(w http.ResponseWriter, r *http.Request) error {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 0 {
+		page = 0
+	}
+
+	data := struct {
+		Kinds    []string
+		Source   string
+		Path     string
+		Name     string
+		Error    string
+		Mails    []LocalMail
+		Page     int
+		PrevPage int
+		NextPage int
+		More     bool
+	}{
+		Kinds:    mailSourceKinds,
+		Source:   r.FormValue("source"),
+		Path:     r.FormValue("path"),
+		Page:     page,
+		PrevPage: page - 1,
+		NextPage: page + 1,
+	}
+
+	if len(data.Path) > 0 {
+		src, err := openMailSource(data.Source, data.Path)
+		if err == nil {
+			data.Name = src.Name()
+			var mails []MailMessage
+			mails, data.More, err = readMailSource(src, page*localMailPageSize, localMailPageSize)
+			for _, msg := range mails {
+				var results []ClassificationResult
+				if results, err = classifyMails([]MailMessage{msg}); err != nil {
+					break
+				}
+				data.Mails = append(data.Mails, LocalMail{msg, results})
+			}
+		}
+		if err != nil {
+			data.Error = err.Error()
+		}
+	}
+
+	return renderPage(w, "local-mail.html", "Local mail archives", "", data)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+// mailText collects the readable parts of a message in document order while
+// walking its MIME tree.
+type mailText struct {
+	parts []textPart
+}
+
+type textPart struct {
+	html bool
+	text string
+	// alternative marks an HTML part whose content is already in a
+	// text/plain part, it is only kept for display
+	alternative bool
+}
+
+// best returns the text of all collected parts, text/html ones converted
+// to text.
+func (t *mailText) best() string {
+	texts := []string{}
+	for _, part := range t.parts {
+		if part.alternative {
+			continue
+		}
+		if part.html {
+			texts = append(texts, htmlToText(part.text, *linkDomains))
+		} else {
+			texts = append(texts, part.text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// html returns the text/html parts for display, if the message has any.
+func (t *mailText) html() string {
+	texts := []string{}
+	for _, part := range t.parts {
+		if part.html {
+			texts = append(texts, part.text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// addAlternative keeps only the best representation of a
+// multipart/alternative: its text/plain parts, or text/html if there are none.
+// The HTML parts are kept for display either way.
+func (t *mailText) addAlternative(alt *mailText) {
+	plain := []textPart{}
+	html := []textPart{}
+	for _, part := range alt.parts {
+		if !part.html {
+			plain = append(plain, part)
+		} else {
+			part.alternative = true
+			html = append(html, part)
+		}
+	}
+	if len(plain) > 0 {
+		t.parts = append(t.parts, plain...)
+		t.parts = append(t.parts, html...)
+	} else {
+		t.parts = append(t.parts, alt.parts...)
+	}
+}
+
+// messageText returns the best text of a Gmail message and its HTML for
+// display, which is empty for plain text mails.
+func messageText(message *gmail.Message) (string, string) {
+	t := &mailText{}
+	t.addGmailPart(message.Payload)
+	return t.best(), t.html()
+}
+
+// mailHeaderDate formats the Date header of a message for display, it is
+// returned as is if it cannot be parsed.
+func mailHeaderDate(value string) string {
+	date, err := mail.ParseDate(value)
+	if err != nil {
+		return value
+	}
+	return date.Local().Format("2006-01-02 15:04")
+}
+
+// addGmailPart walks a message part as returned by the Gmail API. Gmail has
+// already undone the Content-Transfer-Encoding of these parts, body data is
+// the plain content in the part's charset.
+func (t *mailText) addGmailPart(part *gmail.MessagePart) {
+	if part == nil {
+		return
+	}
+
+	header := textproto.MIMEHeader{}
+	for _, h := range part.Headers {
+		header.Add(h.Name, h.Value)
+	}
+	mediaType, params := contentType(header, part.MimeType)
+
+	switch {
+	case mediaType == "multipart/alternative":
+		alt := &mailText{}
+		for _, sub := range part.Parts {
+			alt.addGmailPart(sub)
+		}
+		t.addAlternative(alt)
+	case strings.HasPrefix(mediaType, "multipart/"):
+		for _, sub := range part.Parts {
+			t.addGmailPart(sub)
+		}
+	case mediaType == "message/rfc822":
+		// forwarded mail, Gmail usually parses it into sub parts but
+		// sometimes only hands out the raw message
+		if len(part.Parts) > 0 {
+			for _, sub := range part.Parts {
+				t.addGmailPart(sub)
+			}
+		} else if part.Body != nil && len(part.Body.Data) > 0 {
+			data, err := decodeBase64URL(part.Body.Data)
+			if err != nil {
+				log.Printf("Unable to decode part %s: %v", part.PartId, err)
+				return
+			}
+			if err := t.addRaw(bytes.NewReader(data)); err != nil {
+				log.Printf("Unable to parse forwarded message: %v", err)
+			}
+		}
+	case mediaType == "text/plain" || mediaType == "text/html":
+		if isAttachment(header, part.Filename) || part.Body == nil {
+			return
+		}
+		data, err := decodeBase64URL(part.Body.Data)
+		if err != nil {
+			log.Printf("Unable to decode part %s: %v", part.PartId, err)
+			return
+		}
+		t.add(mediaType, charsetToUTF8(data, params["charset"]))
+	}
+}
+
+// addRaw walks a raw RFC 822 message, e.g. a forwarded one.
+func (t *mailText) addRaw(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+	return t.addRawEntity(textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+func (t *mailText) addRawEntity(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params := contentType(header, "text/plain")
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		target := t
+		if mediaType == "multipart/alternative" {
+			target = &mailText{}
+			defer t.addAlternative(target)
+		}
+
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			// raw parts keep their Content-Transfer-Encoding header, it is
+			// decoded below like for every other entity
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := target.addRawEntity(p.Header, p); err != nil {
+				return err
+			}
+		}
+	case mediaType == "message/rfc822":
+		return t.addRaw(transferDecoder(header, body))
+	case mediaType == "text/plain" || mediaType == "text/html":
+		if isAttachment(header, "") {
+			return nil
+		}
+		b, err := ioutil.ReadAll(transferDecoder(header, body))
+		if err != nil {
+			return err
+		}
+		t.add(mediaType, charsetToUTF8(b, params["charset"]))
+	}
+	return nil
+}
+
+func (t *mailText) add(mediaType, text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	t.parts = append(t.parts, textPart{html: mediaType == "text/html", text: text})
+}
+
+// contentType parses the Content-Type header, falling back to the given
+// media type if it is missing or broken.
+func contentType(header textproto.MIMEHeader, fallback string) (string, map[string]string) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return strings.ToLower(fallback), map[string]string{}
+	}
+	return mediaType, params
+}
+
+func isAttachment(header textproto.MIMEHeader, filename string) bool {
+	if len(filename) > 0 {
+		return true
+	}
+	disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	return disposition == "attachment"
+}
+
+// transferDecoder undoes the Content-Transfer-Encoding of a raw entity.
+func transferDecoder(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// decodeHeader decodes RFC 2047 encoded words in a raw header value, e.g.
+// "=?ISO-8859-1?Q?Gr=FC=DFe?=".
+func decodeHeader(value string) string {
+	dec := mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}}
+
+	decoded, err := dec.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// charsetToUTF8 converts text in the given charset to UTF-8. Charset names
+// are resolved like browsers do, so e.g. ISO-8859-1 is read as Windows-1252
+// and GB2312 as GBK. Text without or with an unknown charset is taken as
+// UTF-8, invalid sequences are replaced.
+func charsetToUTF8(b []byte, charset string) string {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset == "" || charset == "utf-8" || charset == "utf8" {
+		return strings.ToValidUTF8(string(b), "\uFFFD")
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		log.Printf("Unknown charset %s, reading as UTF-8", charset)
+		return strings.ToValidUTF8(string(b), "\uFFFD")
+	}
+	out, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		log.Printf("Unable to convert from charset %s: %v", charset, err)
+		return strings.ToValidUTF8(string(b), "\uFFFD")
+	}
+	return string(out)
+}
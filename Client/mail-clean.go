@@ -0,0 +1,219 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Replies quote the whole conversation, so without cleaning the classifier
+// sees the first message of a thread once for every reply. cleanMailText
+// removes what is not written by the sender of a message: quoted text, the
+// history below a reply header, signatures and legal footers.
+
+// replyHeader matches the line a mail client puts above quoted text, e.g.
+// "On Mon, 3 Jun 2019 at 10:00, Jane <jane@example.com> wrote:".
+var replyHeader = regexp.MustCompile(`(?i)^(` +
+	`on\s.+\swrote\s*:|` + // English
+	`.+@.+\swrote\s*:|` +
+	`am\s.+\sschrieb.*:|` + // German
+	`.+@.+\sschrieb\s*:|` +
+	`le\s.+\sa\s+écrit\s*:|` + // French
+	`el\s.+\sescribió\s*:|` + // Spanish
+	`il\s.+\sha\s+scritto\s*:|` + // Italian
+	`op\s.+\sschreef.*:|` + // Dutch
+	`em\s.+\sescreveu\s*:|` + // Portuguese
+	`w\s+dniu\s.+\spisze\s*:|` + // Polish
+	`den\s.+\sskrev.*:` + // Swedish, Danish, Norwegian
+	`)$`)
+
+// replyHeaderDetails matches what a mail client puts into a reply header
+// besides the name: an address, a time, a year or a numeric date. Without one
+// a line like "On Tuesday our founder wrote:" is only taken for a reply header
+// if quoted lines follow it.
+var replyHeaderDetails = regexp.MustCompile(`@|\d{1,2}:\d{2}|\d{4}|\d{1,2}[./-]\d{1,2}`)
+
+// signatureMaxLines is the most lines of text a signature below a bare "--"
+// line has. The standard delimiter "-- " ends the text whatever follows.
+const signatureMaxLines = 6
+
+// replyHeaderStart matches the first line of a reply header that the mail
+// client wrapped over two lines.
+var replyHeaderStart = regexp.MustCompile(`(?i)^(on|am|le|el|il|op|em|w dniu|den)\s`)
+
+// originalMessage matches the separator Outlook and others put above the
+// message that is replied to.
+var originalMessage = regexp.MustCompile(`(?i)^-{2,}\s*(original message|ursprüngliche nachricht|originalnachricht|message d'origine|mensaje original|messaggio originale|oorspronkelijk bericht|mensagem original)\s*-{2,}$`)
+
+// forwardedMessage matches the separator above a forwarded message. The
+// forwarded text is kept, only its header block is dropped.
+var forwardedMessage = regexp.MustCompile(`(?i)^-{2,}\s*(forwarded message|weitergeleitete nachricht|message transféré|mensaje reenviado|messaggio inoltrato|doorgestuurd bericht|mensagem encaminhada)\s*-{2,}$`)
+
+// quotedHeaderFields are the first two fields of the header block Outlook
+// puts above the message replied to instead of a separator.
+var quotedHeaderFields = map[string][]string{
+	"from:": {"sent:", "date:"},
+	"von:":  {"gesendet:", "datum:"},
+	"de :":  {"envoyé :", "date :"},
+	"de:":   {"enviado:", "fecha:", "envoyé :", "data:"},
+	"da:":   {"inviato:", "data:"},
+	"van:":  {"verzonden:", "datum:"},
+}
+
+// mobileSignatures are lines added by mail apps.
+var mobileSignatures = regexp.MustCompile(`(?i)^(sent from my .+|sent from (outlook|mail) for .+|get outlook for .+|von meinem .+ gesendet|envoyé de mon .+|enviado desde mi .+|inviato da .+)$`)
+
+// disclaimerPhrases mark a legal footer, the paragraph containing one is
+// dropped.
+var disclaimerPhrases = []string{
+	"if you are not the intended recipient",
+	"this e-mail and any attachments",
+	"this email and any attachments",
+	"this message and any attachments",
+	"this message is intended only for",
+	"this e-mail is intended only for",
+	"this email is intended only for",
+	"intended solely for the use of",
+	"this email has been scanned",
+	"please consider the environment before printing",
+	"wenn sie nicht der richtige adressat sind",
+	"falls sie nicht der beabsichtigte empfänger sind",
+	"diese e-mail enthält vertrauliche",
+	"si vous n'êtes pas le destinataire",
+	"ce message et toutes les pièces jointes",
+	"si usted no es el destinatario",
+	"se avete ricevuto questo messaggio per errore",
+}
+
+// cleanMailText returns the part of a mail body written by its sender.
+func cleanMailText(body string) string {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	kept := []string{}
+
+lines:
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+
+		switch {
+		case strings.HasPrefix(line, ">"):
+			continue
+		case line == "--" && isSignature(lines[i:]):
+			// the rest is signature or quoted
+			break lines
+		case originalMessage.MatchString(line):
+			break lines
+		case isQuotedHeaderBlock(lines[i:]) && afterSenderText(lines[:i], kept):
+			break lines
+		case forwardedMessage.MatchString(line):
+			// skip the header block up to the first blank line
+			for i+1 < len(lines) && len(strings.TrimSpace(lines[i+1])) > 0 {
+				i++
+			}
+			continue
+		case mobileSignatures.MatchString(line) || len(line) > 1 && strings.Trim(line, "_") == "":
+			continue
+		}
+
+		header, headerText := replyHeader.MatchString(line), line
+		skip := 0
+		if !header && replyHeaderStart.MatchString(line) && i+1 < len(lines) &&
+			replyHeader.MatchString(line+" "+strings.TrimSpace(lines[i+1])) {
+			header, headerText, skip = true, line+" "+strings.TrimSpace(lines[i+1]), 1
+		}
+		if header {
+			// with quote markers the reply may continue below the quoted
+			// text, without them everything below is quoted
+			if next := nextTextLine(lines[i+skip+1:]); strings.HasPrefix(next, ">") {
+				i += skip
+				continue
+			}
+			if replyHeaderDetails.MatchString(headerText) {
+				break lines
+			}
+		}
+		if len(line) == 0 && len(kept) > 0 && len(strings.TrimSpace(kept[len(kept)-1])) == 0 {
+			// a single blank line is left of the removed quotes
+			continue
+		}
+		kept = append(kept, lines[i])
+	}
+
+	return strings.TrimSpace(dropDisclaimers(strings.Join(kept, "\n")))
+}
+
+// isQuotedHeaderBlock reports whether lines start with a header block like
+// "From: Jane\nSent: Monday" that Outlook puts above the message replied to.
+func isQuotedHeaderBlock(lines []string) bool {
+	first := strings.ToLower(strings.TrimSpace(lines[0]))
+	for field, next := range quotedHeaderFields {
+		if !strings.HasPrefix(first, field) {
+			continue
+		}
+		for i := 1; i < len(lines) && i < 4; i++ {
+			line := strings.ToLower(strings.TrimSpace(lines[i]))
+			for _, n := range next {
+				if strings.HasPrefix(line, n) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isSignature reports whether lines start with a signature delimiter: "-- "
+// as it should be, or "--" without the space that some clients strip, if only
+// a few lines follow it.
+func isSignature(lines []string) bool {
+	if lines[0] == "-- " {
+		return true
+	}
+	text := 0
+	for _, line := range lines[1:] {
+		if len(strings.TrimSpace(line)) > 0 {
+			text++
+		}
+	}
+	return text <= signatureMaxLines
+}
+
+// afterSenderText reports whether the line following before starts a new
+// paragraph below the text the sender wrote, the lines of which were kept. A
+// header block anywhere else, e.g. the order details of a shop, is no quote.
+func afterSenderText(before, kept []string) bool {
+	if len(before) == 0 || len(nextTextLine(kept)) == 0 {
+		return false
+	}
+	// Outlook separates the quote with a line of underscores
+	prev := strings.TrimSpace(before[len(before)-1])
+	return len(prev) == 0 || strings.Trim(prev, "_") == ""
+}
+
+// nextTextLine returns the first line that is not blank.
+func nextTextLine(lines []string) string {
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			return line
+		}
+	}
+	return ""
+}
+
+// dropDisclaimers removes the paragraphs that contain a disclaimer phrase.
+func dropDisclaimers(text string) string {
+	paragraphs := strings.Split(text, "\n\n")
+	kept := []string{}
+	for _, p := range paragraphs {
+		lower := strings.ToLower(strings.Join(strings.Fields(p), " "))
+		disclaimer := false
+		for _, phrase := range disclaimerPhrases {
+			if strings.Contains(lower, phrase) {
+				disclaimer = true
+				break
+			}
+		}
+		if !disclaimer {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, "\n\n")
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestCleanMailText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		// replies
+		{"english", "Sounds good.\n\nOn Mon, 3 Jun 2019 at 10:00, Jane <jane@example.com> wrote:\nShall we meet?", "Sounds good."},
+		{"english wrapped", "Sounds good.\n\nOn Mon, 3 Jun 2019 at 10:00, Jane Doe\n<jane@example.com> wrote:\nShall we meet?", "Sounds good."},
+		{"address only", "Yes.\n\njane@example.com wrote:\nShall we meet?", "Yes."},
+		{"german", "Passt.\n\nAm 03.06.2019 um 10:00 schrieb Jane Doe <jane@example.com>:\nTreffen wir uns?", "Passt."},
+		{"french", "D'accord.\n\nLe lun. 3 juin 2019 à 10:00, Jane <jane@example.com> a écrit :\nOn se voit ?", "D'accord."},
+		{"spanish", "Vale.\n\nEl lun, 3 jun 2019 a las 10:00, Jane (<jane@example.com>) escribió:\n¿Nos vemos?", "Vale."},
+		{"italian", "Va bene.\n\nIl giorno lun 3 giu 2019 alle ore 10:00 Jane <jane@example.com> ha scritto:\nCi vediamo?", "Va bene."},
+		{"dutch", "Prima.\n\nOp ma 3 jun. 2019 om 10:00 schreef Jane <jane@example.com>:\nZien we elkaar?", "Prima."},
+		{"portuguese", "Combinado.\n\nEm seg., 3 de jun. de 2019 às 10:00, Jane <jane@example.com> escreveu:\nVamos nos encontrar?", "Combinado."},
+		{"polish", "Dobrze.\n\nW dniu 3.06.2019 o 10:00 Jane <jane@example.com> pisze:\nSpotkamy się?", "Dobrze."},
+		{"swedish", "Bra.\n\nDen 3 juni 2019 10:00 skrev Jane <jane@example.com>:\nSes vi?", "Bra."},
+		{"interleaved quotes", "Hi,\n\nOn Mon, Jane wrote:\n> first question\n\nfirst answer\n\n> second question\n\nsecond answer", "Hi,\n\nfirst answer\n\nsecond answer"},
+		{"original message", "Done.\n\n-----Original Message-----\nFrom: Jane\nPlease do it.", "Done."},
+		{"ursprüngliche nachricht", "Erledigt.\n\n-----Ursprüngliche Nachricht-----\nVon: Jane\nBitte erledigen.", "Erledigt."},
+
+		// Outlook header blocks
+		{"outlook english", "Done.\n\nFrom: Jane Doe <jane@example.com>\nSent: Monday, June 3, 2019 10:00\nTo: Joe\nSubject: Task\n\nPlease do it.", "Done."},
+		{"outlook underscores", "Done.\n________________________________\nFrom: Jane Doe\nSent: Monday, June 3, 2019 10:00\n\nPlease do it.", "Done."},
+		{"outlook german", "Erledigt.\n\nVon: Jane Doe\nGesendet: Montag, 3. Juni 2019 10:00\nAn: Joe\n\nBitte erledigen.", "Erledigt."},
+		{"outlook french", "Fait.\n\nDe : Jane Doe\nEnvoyé : lundi 3 juin 2019 10:00\nÀ : Joe\n\nMerci de le faire.", "Fait."},
+		{"outlook spanish", "Hecho.\n\nDe: Jane Doe\nEnviado: lunes, 3 de junio de 2019 10:00\nPara: Joe\n\nHazlo por favor.", "Hecho."},
+		{"outlook italian", "Fatto.\n\nDa: Jane Doe\nInviato: lunedì 3 giugno 2019 10:00\nA: Joe\n\nFallo per favore.", "Fatto."},
+		{"outlook dutch", "Klaar.\n\nVan: Jane Doe\nVerzonden: maandag 3 juni 2019 10:00\nAan: Joe\n\nGraag doen.", "Klaar."},
+
+		// signatures and footers
+		{"signature", "See you.\n\n-- \nJoe Bloggs\nExample Ltd", "See you."},
+		{"mobile", "On my way.\n\nSent from my iPhone", "On my way."},
+		{"mobile german", "Bin unterwegs.\n\nVon meinem iPhone gesendet", "Bin unterwegs."},
+		{"disclaimer", "The report is attached.\n\nThis e-mail and any attachments are confidential. If you are not the intended recipient, delete it.", "The report is attached."},
+
+		// mails that are no replies keep their text
+		{"plain", "Hello,\n\nthe meeting moved to Tuesday.\n\nBest, Joe", "Hello,\n\nthe meeting moved to Tuesday.\n\nBest, Joe"},
+		{"order confirmation", "From: Example Shop <orders@shop.example>\nDate: 3 June 2019\nOrder: 12345\n\nThank you for your order.",
+			"From: Example Shop <orders@shop.example>\nDate: 3 June 2019\nOrder: 12345\n\nThank you for your order."},
+		{"order details", "Thank you for your order.\nFrom: Example Shop\nDate: 3 June 2019\nTotal: 12.00 EUR", "Thank you for your order.\nFrom: Example Shop\nDate: 3 June 2019\nTotal: 12.00 EUR"},
+		{"shipping", "Your parcel is on its way.\nFrom: Berlin\nSent: 3 June 2019\nTo: Munich", "Your parcel is on its way.\nFrom: Berlin\nSent: 3 June 2019\nTo: Munich"},
+		{"story", "On Tuesday our founder wrote:\n\nWe are moving to a new office.\n\nSee you there!", "On Tuesday our founder wrote:\n\nWe are moving to a new office.\n\nSee you there!"},
+		{"story with quotes", "Hi,\n\nOn Tuesday our founder wrote:\n> We are moving.\n\nSo pack your things.", "Hi,\n\nSo pack your things."},
+		{"dashes", "Agenda\n--\nItem 1\nItem 2\nItem 3\nItem 4\nItem 5\nItem 6\nItem 7", "Agenda\n--\nItem 1\nItem 2\nItem 3\nItem 4\nItem 5\nItem 6\nItem 7"},
+		{"signature without space", "See you.\n\n--\nJoe Bloggs\nExample Ltd", "See you."},
+		{"quote of a text", "As the saying goes:\n\n\"On a clear day you can see forever\"", "As the saying goes:\n\n\"On a clear day you can see forever\""},
+		{"crlf", "Hello\r\n\r\nworld\r\n", "Hello\n\nworld"},
+	}
+	for _, tt := range tests {
+		if got := cleanMailText(tt.in); got != tt.want {
+			t.Errorf("%s: cleanMailText(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailSource produces the messages of a mailbox that is not Gmail, e.g. a
+// local archive.
+type MailSource interface {
+	// Name describes the source for the UI.
+	Name() string
+	// Messages calls fn for every message in a stable order. Returning
+	// errStopSource from fn ends the iteration without an error.
+	Messages(fn func(MailMessage) error) error
+}
+
+var errStopSource = errors.New("stop reading mail source")
+
+// pagedMailSource is a MailSource that can start reading at a message without
+// parsing the ones before it.
+type pagedMailSource interface {
+	MailSource
+	// MessagesFrom calls fn like Messages, starting with the message at
+	// offset.
+	MessagesFrom(offset int, fn func(MailMessage) error) error
+}
+
+// mailSourceKinds are the kinds understood by openMailSource.
+var mailSourceKinds = []string{"mbox", "maildir", "eml"}
+
+// openMailSource opens a local archive. If kind is empty it is guessed from
+// path: a directory with cur/ and new/ is a Maildir, any other directory or a
+// .eml file holds .eml files and everything else is an mbox file.
+func openMailSource(kind, path string) (MailSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == "" {
+		kind = "mbox"
+		if info.IsDir() {
+			kind = "eml"
+			if isDir(filepath.Join(path, "cur")) && isDir(filepath.Join(path, "new")) {
+				kind = "maildir"
+			}
+		} else if strings.EqualFold(filepath.Ext(path), ".eml") {
+			kind = "eml"
+		}
+	}
+
+	switch kind {
+	case "mbox":
+		if info.IsDir() {
+			return nil, fmt.Errorf("%s is a directory, not an mbox file", path)
+		}
+		return &mboxSource{path}, nil
+	case "maildir":
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a Maildir directory", path)
+		}
+		return &maildirSource{path}, nil
+	case "eml":
+		return &emlSource{path}, nil
+	}
+	return nil, fmt.Errorf("unknown mail source %q", kind)
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// readMailSource returns up to limit messages starting at offset and whether
+// the source has more messages after them. Messages that cannot be parsed
+// still count for the offset of a pagedMailSource.
+func readMailSource(src MailSource, offset, limit int) ([]MailMessage, bool, error) {
+	mails := []MailMessage{}
+	more := false
+	index := 0
+	messages := src.Messages
+	if paged, ok := src.(pagedMailSource); ok {
+		index = offset
+		messages = func(fn func(MailMessage) error) error {
+			return paged.MessagesFrom(offset, fn)
+		}
+	}
+	err := messages(func(msg MailMessage) error {
+		defer func() { index++ }()
+		if index < offset {
+			return nil
+		}
+		if len(mails) == limit {
+			more = true
+			return errStopSource
+		}
+		mails = append(mails, msg)
+		return nil
+	})
+	return mails, more, err
+}
+
+// parseRawMessage turns an RFC 822 message into a MailMessage.
+func parseRawMessage(r io.Reader, id string) (MailMessage, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return MailMessage{}, err
+	}
+
+	t := &mailText{}
+	if err := t.addRawEntity(textproto.MIMEHeader(msg.Header), msg.Body); err != nil {
+		return MailMessage{}, err
+	}
+
+	mailMsg := MailMessage{
+		ID:      id,
+		Subject: decodeHeader(msg.Header.Get("Subject")),
+		From:    decodeHeader(msg.Header.Get("From")),
+		To:      decodeHeader(msg.Header.Get("To")),
+		Date:    mailHeaderDate(msg.Header.Get("Date")),
+		Body:    t.best(),
+		HTML:    t.html(),
+
+		MessageID: msg.Header.Get("Message-Id"),
+		ListID:    listID(msg.Header.Get("List-Id")),
+		Bulk:      isBulkMail(msg.Header.Get("Precedence"), msg.Header.Get("List-Unsubscribe")),
+	}
+	mailMsg.Short = snippet(mailMsg.Body, 200)
+	return mailMsg, nil
+}
+
+// snippet shortens text to at most n runes on a single line, like the
+// snippets Gmail hands out.
+func snippet(text string, n int) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) > n {
+		return string(runes[:n]) + "..."
+	}
+	return string(runes)
+}
+
+// mboxSource reads an mbox file as exported by Google Takeout. Lines quoted
+// as ">From " (mboxrd) are unquoted, messages are numbered from 1.
+type mboxSource struct {
+	path string
+}
+
+func (s *mboxSource) Name() string { return "mbox " + s.path }
+
+func (s *mboxSource) Messages(fn func(MailMessage) error) error {
+	return s.MessagesFrom(0, fn)
+}
+
+// MessagesFrom looks up where the message at offset starts in the index of
+// the file, see mboxIndexOf.
+func (s *mboxSource) MessagesFrom(offset int, fn func(MailMessage) error) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	count := 0
+	if offset > 0 {
+		starts, err := mboxIndexOf(f)
+		if err != nil {
+			return err
+		}
+		if offset >= len(starts) {
+			return nil
+		}
+		if _, err := f.Seek(starts[offset], io.SeekStart); err != nil {
+			return err
+		}
+		count = offset
+	}
+
+	r := bufio.NewReader(f)
+	var buf bytes.Buffer
+	inMessage := false
+
+	flush := func() error {
+		if !inMessage {
+			return nil
+		}
+		count++
+		msg, err := parseRawMessage(bytes.NewReader(buf.Bytes()), strconv.Itoa(count))
+		buf.Reset()
+		if err != nil {
+			log.Printf("Skipping message %d in %s: %v", count, s.path, err)
+			return nil
+		}
+		return fn(msg)
+	}
+
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if err := flush(); err != nil {
+				return ignoreStop(err)
+			}
+			inMessage = true
+		} else if inMessage {
+			if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+				line = line[1:]
+			}
+			buf.Write(line)
+		}
+
+		if readErr == io.EOF {
+			return ignoreStop(flush())
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// mboxIndex holds the offsets of the messages in the mbox files read so far,
+// so browsing a large archive page by page only scans it once.
+var mboxIndex = struct {
+	sync.Mutex
+	files map[string]mboxOffsets // by path
+}{files: map[string]mboxOffsets{}}
+
+type mboxOffsets struct {
+	size    int64
+	modTime time.Time
+	starts  []int64 // of the "From " line of every message
+}
+
+// mboxIndexOf returns where the messages of the open mbox file f start. The
+// index is built again when the file changed since it was last built.
+func mboxIndexOf(f *os.File) ([]int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	mboxIndex.Lock()
+	defer mboxIndex.Unlock()
+	if index, ok := mboxIndex.files[f.Name()]; ok && index.size == info.Size() && index.modTime.Equal(info.ModTime()) {
+		return index.starts, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	starts := []int64{}
+	r := bufio.NewReader(f)
+	pos := int64(0)
+	lineStart := true
+	for {
+		// ReadSlice returns overlong lines in parts, only the first one
+		// can start a message
+		line, err := r.ReadSlice('\n')
+		if lineStart && bytes.HasPrefix(line, []byte("From ")) {
+			starts = append(starts, pos)
+		}
+		pos += int64(len(line))
+		lineStart = err != bufio.ErrBufferFull
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+
+	mboxIndex.files[f.Name()] = mboxOffsets{info.Size(), info.ModTime(), starts}
+	return starts, nil
+}
+
+// maildirSource reads the messages in cur/ and new/ of a Maildir. The ID of a
+// message is its unique file name without the flags.
+type maildirSource struct {
+	dir string
+}
+
+func (s *maildirSource) Name() string { return "Maildir " + s.dir }
+
+func (s *maildirSource) Messages(fn func(MailMessage) error) error {
+	return s.MessagesFrom(0, fn)
+}
+
+// MessagesFrom lists the files and only parses those from offset on.
+func (s *maildirSource) MessagesFrom(offset int, fn func(MailMessage) error) error {
+	paths, ids := []string{}, []string{}
+	for _, sub := range []string{"cur", "new"} {
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, sub))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			paths = append(paths, filepath.Join(s.dir, sub, file.Name()))
+			ids = append(ids, strings.SplitN(file.Name(), ":", 2)[0])
+		}
+	}
+
+	for i := offset; i < len(paths); i++ {
+		if err := readMessageFile(paths[i], ids[i], fn); err != nil {
+			return ignoreStop(err)
+		}
+	}
+	return nil
+}
+
+// emlSource reads a single .eml file or all .eml files below a directory. The
+// ID of a message is its path relative to the directory.
+type emlSource struct {
+	path string
+}
+
+func (s *emlSource) Name() string { return ".eml files in " + s.path }
+
+func (s *emlSource) Messages(fn func(MailMessage) error) error {
+	return s.MessagesFrom(0, fn)
+}
+
+// MessagesFrom lists the files and only parses those from offset on.
+func (s *emlSource) MessagesFrom(offset int, fn func(MailMessage) error) error {
+	files := []string{}
+	err := filepath.Walk(s.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && (path == s.path || strings.EqualFold(filepath.Ext(path), ".eml")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	if offset > len(files) {
+		offset = len(files)
+	}
+	for _, file := range files[offset:] {
+		id, err := filepath.Rel(s.path, file)
+		if err != nil || id == "." {
+			id = filepath.Base(file)
+		}
+		if err := readMessageFile(file, filepath.ToSlash(id), fn); err != nil {
+			return ignoreStop(err)
+		}
+	}
+	return nil
+}
+
+// readMessageFile parses a file holding a single message and passes it to fn.
+// Files that cannot be parsed are skipped.
+func readMessageFile(path, id string, fn func(MailMessage) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	msg, err := parseRawMessage(bufio.NewReader(f), id)
+	if err != nil {
+		log.Printf("Skipping message %s: %v", path, err)
+		return nil
+	}
+	return fn(msg)
+}
+
+func ignoreStop(err error) error {
+	if err == errStopSource {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeMbox(t *testing.T, path string, subjects ...string) {
+	var b strings.Builder
+	for _, subject := range subjects {
+		fmt.Fprintf(&b, "From sender@example.org Mon Jan  2 15:04:05 2006\nFrom: sender@example.org\nSubject: %s\n\n%s body\n>From the quoted line\n\n", subject, subject)
+	}
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func subjects(mails []MailMessage) []string {
+	s := []string{}
+	for _, mail := range mails {
+		s = append(s, mail.Subject)
+	}
+	return s
+}
+
+func readPages(t *testing.T, src MailSource, limit int) [][]string {
+	pages := [][]string{}
+	for offset := 0; ; offset += limit {
+		mails, more, err := readMailSource(src, offset, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, subjects(mails))
+		if !more {
+			return pages
+		}
+	}
+}
+
+func TestReadMailSourceMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "All mail.mbox")
+	writeMbox(t, path, "one", "two", "three", "four", "five")
+	src, err := openMailSource("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"one", "two"}, {"three", "four"}, {"five"}}
+	if got := readPages(t, src, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages %v, want %v", got, want)
+	}
+	mails, _, err := readMailSource(src, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 || mails[0].ID != "5" || strings.TrimSpace(mails[0].Body) != "five body\nFrom the quoted line" {
+		t.Errorf("last page %+v", mails)
+	}
+	if mails, more, err := readMailSource(src, 10, 2); len(mails) != 0 || more || err != nil {
+		t.Errorf("page after the end got %v, %v, %v", subjects(mails), more, err)
+	}
+
+	// the index is built again for a changed file
+	writeMbox(t, path, "one", "two", "three", "four", "five", "six and a longer subject")
+	want = [][]string{{"one", "two"}, {"three", "four"}, {"five", "six and a longer subject"}}
+	if got := readPages(t, src, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages after appending %v, want %v", got, want)
+	}
+}
+
+func TestReadMailSourceMaildir(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, name := range []string{"cur/1.a:2,S", "cur/2.b:2,", "new/3.c", "cur/.hidden"} {
+		msg := fmt.Sprintf("From: sender@example.org\nSubject: %d\n\nbody\n", i+1)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(msg), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src, err := openMailSource("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"1", "2"}, {"3"}}
+	if got := readPages(t, src, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages %v, want %v", got, want)
+	}
+	mails, _, err := readMailSource(src, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 || mails[0].ID != "2.b" {
+		t.Errorf("second message %+v", mails)
+	}
+}
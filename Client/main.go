@@ -1,82 +1,142 @@
 package main
 
 import (
+	"flag"
+	"log"
 	"net/http"
 	"strconv"
-	"text/template"
+	"time"
 
 	"github.com/pkg/browser"
 )
 
-func webCrawlerQuora(w http.ResponseWriter, r *http.Request) {
+var (
+	gmailEndpoint     = flag.String("gmail-endpoint", "", "base URL of the Gmail API, e.g. a local fake server for testing")
+	writeLabels       = flag.Bool("write-labels", false, "request modify access to write classification results back to Gmail as labels")
+	sourceKind        = flag.String("source", "", "kind of the local mail archive given with -path: mbox, maildir or eml (guessed if empty)")
+	sourcePath        = flag.String("path", "", "classify the local mail archive at this path, print the results and exit")
+	tokenKeyFile      = flag.String("token-key-file", "", "encrypt the stored Gmail tokens with the key in this file instead of $"+passphraseEnv)
+	rotateKey         = flag.Bool("rotate-token-key", false, "re-encrypt the stored Gmail tokens with -new-token-key-file or $"+newPassphraseEnv+" and exit")
+	newKeyFile        = flag.String("new-token-key-file", "", "key file to re-encrypt the tokens with, see -rotate-token-key")
+	revokeAccount     = flag.String("revoke", "", "revoke and delete the stored Gmail token of this account (or \"all\") and exit")
+	imapInsecure      = flag.Bool("imap-insecure", false, "allow logging in to IMAP servers that support neither TLS nor STARTTLS, which sends the password in plain text")
+	linkDomains       = flag.Bool("link-domains", false, "keep the domain of links when converting HTML mails to text for the classifier, e.g. \"Track your order (shop.example.com)\"")
+	gmailQuotaRate    = flag.Int("gmail-quota-rate", 250, "Gmail API quota units to spend per second at most, 0 for no limit")
+	gmailRetries      = flag.Int("gmail-retries", 5, "how often a Gmail API call is retried after a rate limit or server error")
+	gmailMaxBackoff   = flag.Duration("gmail-max-backoff", 32*time.Second, "the longest wait between two retries of a Gmail API call")
+	gmailBatchSize    = flag.Int("gmail-batch-size", 20, "threads fetched with one Gmail batch request, 1 fetches them one by one")
+	gmailFetchWorkers = flag.Int("gmail-fetch-workers", 4, "Gmail requests fetching threads at the same time")
+	cacheDir          = flag.String("cache-dir", "mail-cache", "directory of the cache of fetched Gmail messages, empty to turn the cache off")
+	cacheMaxSize      = flag.Int("cache-max-size", 500, "size of the message cache in MB, the least recently used messages are removed beyond it, 0 for no limit")
+	cacheMaxAge       = flag.Duration("cache-max-age", 30*24*time.Hour, "messages not used for this long are removed from the message cache, 0 keeps them")
+	classifyMode      = flag.String("classify-mode", threadMode, "classify a thread as one text (\"thread\") or each message on its own (\"message\")")
+	combineStrategy   = flag.String("combine", combineLatest, "how the message scores of a thread are combined in -classify-mode message: latest, length or max")
+	headerPriorWeight = flag.Float64("header-prior-weight", 0.3, "how much the categories learned for a sender, mailing list or Gmail category shift the text scores, 0 disables")
+)
+
+func webCrawlerQuora(w http.ResponseWriter, r *http.Request) error {
+	data := struct {
+		Amount   int64
+		Category string
+	}{}
+
 	if len(r.URL.Path) > len("/crawlerQuora/") {
 		subPage := r.URL.Path[len("/crawlerQuora/"):]
 
 		if subPage == "crawlCategories" {
-			amount, _ := strconv.ParseInt(r.FormValue("amount"), 10, 64)
-
-			htmlBody := `<h1>Quora Crawler</h1>
-        <p><h2>Crawling {{.}} different categories from Quora... This can take some time, you can follow the progress in the command window!</h2></p>
-          `
-
-			t, _ := template.New("quora-crawling").Parse(htmlBody)
-			t.Execute(w, amount)
-
-			crawlAndExportQuoraCategories(int(amount))
+			data.Amount, _ = strconv.ParseInt(r.FormValue("amount"), 10, 64)
 		} else if subPage == "fetchCategory" {
-			category := r.FormValue("category")
-
-			htmlBody := `<h1>Quora Crawler</h1>
-        <p><h2>Fetching articles for Quora category {{.}}... This can take some time, you can follow the progress in the command window!</h2></p>
-          `
-
-			t, _ := template.New("quora-crawling").Parse(htmlBody)
-			t.Execute(w, category)
-
-			empty := map[string]int{}
-			fetchAndExportQuoraCategory(category, &empty)
+			data.Category = r.FormValue("category")
 		}
+	}
 
-	} else {
-		htmlBody := `<h1>Quora Crawler</h1>
-    <p><form action="/crawlerQuora/crawlCategories" method="POST">
-      <div>Enter the amount of categories you want to crawl: <input type="text" name="amount"></div>
-      <div><input type="submit" value="Go"></div>
-    </form></p>
-    <p><form action="/crawlerQuora/fetchCategory" method="POST">
-      <div>Fetch articles from a specific category: <input type="text" name="category"></div>
-      <div><input type="submit" value="Go"></div>
-    </form></p>
-      `
+	if err := renderPage(w, "quora.html", "Quora Crawler", "", data); err != nil {
+		return err
+	}
+	if data.Amount == 0 && len(data.Category) == 0 {
+		return nil
+	}
 
-		w.Write([]byte(htmlBody))
+	// show the page while crawling
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	if data.Amount > 0 {
+		crawlAndExportQuoraCategories(int(data.Amount))
+	} else {
+		empty := map[string]int{}
+		fetchAndExportQuoraCategory(data.Category, &empty)
 	}
+	return nil
 }
 
-func webCrawlerMain(w http.ResponseWriter, r *http.Request) {
-	htmlBody := `<h1>Crawler</h1>
-    <p><h2><a href="/crawlerQuora">Quora</a></p>
-    <p><h2><a href="/crawlerMedium">Medium</a></p>
-    `
-
-	w.Write([]byte(htmlBody))
+func webCrawlerMain(w http.ResponseWriter, r *http.Request) error {
+	return renderPage(w, "crawler.html", "Crawler", "", nil)
 }
 
-func webMain(w http.ResponseWriter, r *http.Request) {
-	htmlBody := `<h1>Mail Classifier</h1>
-    <p><h2><a href="/gmailFetch">E-Mails from Gmail</a></p>
-    <p><h2><a href="/crawlerMain">Crawler</a></p>
-    `
-
-	w.Write([]byte(htmlBody))
+func webMain(w http.ResponseWriter, r *http.Request) error {
+	return renderPage(w, "main.html", "", "", nil)
 }
 
 func main() {
-	http.HandleFunc("/", webMain)
-	http.HandleFunc("/gmailFetch/", webGmailFetch)
-	http.HandleFunc("/gmailView/", webGmailView)
-	http.HandleFunc("/crawlerMain", webCrawlerMain)
-	http.HandleFunc("/crawlerQuora/", webCrawlerQuora)
-	http.ListenAndServe(":8080", nil)
+	flag.Parse()
+
+	if err := defaultClassifyOptions().validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateGmailFlags(); err != nil {
+		log.Fatal(err)
+	}
+
+	var err error
+	if tokenCacheKey, err = tokenKeyFrom(*tokenKeyFile, passphraseEnv); err != nil {
+		log.Fatalf("Unable to read the token key: %v", err)
+	}
+	if *rotateKey {
+		newKey, err := tokenKeyFrom(*newKeyFile, newPassphraseEnv)
+		if err != nil {
+			log.Fatalf("Unable to read the new token key: %v", err)
+		}
+		if err := rotateTokenKey(newKey); err != nil {
+			log.Fatalf("Unable to rotate the token key: %v", err)
+		}
+		return
+	}
+	if len(*revokeAccount) > 0 {
+		if err := revokeTokens(*revokeAccount); err != nil {
+			log.Fatalf("Unable to revoke the token: %v", err)
+		}
+		return
+	}
+
+	if len(*sourcePath) > 0 {
+		err := classifyMailSource(*sourceKind, *sourcePath)
+		flushPriors()
+		if err != nil {
+			log.Fatalf("Unable to classify %s: %v", *sourcePath, err)
+		}
+		return
+	}
+	loadIMAPState()
+	go migrateLegacyToken()
+	go evictMessageCache()
+
+	http.Handle("/", webHandler(webMain))
+	http.Handle("/gmailFetch/", webHandler(webGmailFetch))
+	http.Handle("/gmailView/", webHandler(webGmailView))
+	http.Handle("/gmailClassifyAll/", webHandler(webGmailClassifyAll))
+	http.Handle("/gmailLabel/", webHandler(webGmailLabel))
+	http.Handle("/gmailExportLabels/", webHandler(webGmailExportLabels))
+	http.Handle("/gmailAccounts/", webHandler(webGmailAccounts))
+	http.Handle("/gmailSettings/", webHandler(webGmailSettings))
+	http.Handle("/gmailLogin/", webHandler(webGmailLogin))
+	http.Handle("/oauth2callback", webHandler(webOAuth2Callback))
+	http.Handle("/localMail/", webHandler(webLocalMail))
+	http.Handle("/imap/", webHandler(webIMAP))
+	http.Handle("/crawlerMain", webHandler(webCrawlerMain))
+	http.Handle("/crawlerQuora/", webHandler(webCrawlerQuora))
+	// only reachable from this machine, the pages read local mail archives
+	// and IMAP mailboxes with the paths and passwords entered in them
+	http.ListenAndServe("127.0.0.1:8080", nil)
 	browser.OpenURL("http://localhost:8080")
 }
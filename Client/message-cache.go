@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// The message cache keeps fetched Gmail messages on disk together with the
+// text extracted from them, one file per message in -cache-dir/<account>/.
+// A message is only taken from the cache if its historyId did not change,
+// which Gmail bumps on every change of the message, labels included. A
+// thread file lists the messages of a thread at a historyId, so an unchanged
+// thread is read without fetching it again. The text of a message is only
+// used if it was extracted with the current settings, otherwise it is
+// extracted again from the cached message.
+//
+// The files are only readable by the user, like the tokens, but they are not
+// encrypted: anyone who can read the user's files can read the cached mail.
+// Start with an empty -cache-dir to keep no mail on disk.
+
+// messageCacheEvictInterval is how often the cache is checked against
+// -cache-max-size and -cache-max-age while messages are added.
+const messageCacheEvictInterval = 5 * time.Minute
+
+// messageTextVersion is increased whenever the text extracted from messages
+// changes, e.g. with a new HTML converter.
+const messageTextVersion = 1
+
+// messageCacheFileName matches the files written by the cache: messages,
+// threads and the temporary files of saveJSON. Nothing else is evicted.
+var messageCacheFileName = regexp.MustCompile(`^(thread-)?[0-9a-f]+\.json(\.tmp[0-9]+)?$`)
+
+type cachedMessage struct {
+	HistoryID uint64
+	Version   string // settings Mail was extracted with
+	Message   *gmail.Message
+	Mail      MailMessage
+}
+
+type cachedThread struct {
+	HistoryID uint64
+	Fetched   time.Time
+	Messages  []cachedMessageRef
+}
+
+// messageCacheEntry is a file of the cache, used is when it was last read or
+// written.
+type messageCacheEntry struct {
+	path string
+	size int64
+	used time.Time
+}
+
+type cachedMessageRef struct {
+	ID        string
+	HistoryID uint64
+}
+
+var messageCacheEviction = struct {
+	sync.Mutex
+	last    time.Time
+	running bool
+}{}
+
+// messageCacheDir returns the cache directory of account, or "" if the cache
+// is off.
+func messageCacheDir(account string) string {
+	if *cacheDir == "" || account == "" {
+		return ""
+	}
+	return filepath.Join(*cacheDir, url.QueryEscape(account))
+}
+
+// messageCacheVersion identifies the code and settings the text of messages
+// is extracted with.
+func messageCacheVersion() string {
+	return fmt.Sprintf("%d links=%t", messageTextVersion, *linkDomains)
+}
+
+func messageCacheFile(dir, id string) string {
+	return filepath.Join(dir, url.QueryEscape(id)+".json")
+}
+
+func threadCacheFile(dir, id string) string {
+	return filepath.Join(dir, "thread-"+url.QueryEscape(id)+".json")
+}
+
+// cachedThreadAt returns a thread and its mails from the cache if it was
+// cached at historyID.
+func cachedThreadAt(account, threadID string, historyID uint64) (*gmail.Thread, []MailMessage, bool) {
+	if historyID == 0 {
+		return nil, nil, false
+	}
+	thread, mails, _, ok := loadCachedThread(account, threadID, historyID)
+	return thread, mails, ok
+}
+
+// cachedThreadAny returns whatever version of a thread is cached, for when
+// Gmail cannot be reached, and when it was fetched.
+func cachedThreadAny(account, threadID string) (*gmail.Thread, []MailMessage, time.Time, bool) {
+	return loadCachedThread(account, threadID, 0)
+}
+
+func loadCachedThread(account, threadID string, historyID uint64) (*gmail.Thread, []MailMessage, time.Time, bool) {
+	dir := messageCacheDir(account)
+	if dir == "" {
+		return nil, nil, time.Time{}, false
+	}
+
+	var index cachedThread
+	if err := loadJSON(threadCacheFile(dir, threadID), &index); err != nil {
+		log.Printf("Unable to read cached thread %s: %v", threadID, err)
+		return nil, nil, time.Time{}, false
+	}
+	if index.HistoryID == 0 || (historyID != 0 && index.HistoryID != historyID) {
+		return nil, nil, time.Time{}, false
+	}
+
+	thread := &gmail.Thread{Id: threadID, HistoryId: index.HistoryID}
+	mails := []MailMessage{}
+	files := []string{threadCacheFile(dir, threadID)}
+	version := messageCacheVersion()
+	for _, ref := range index.Messages {
+		var cached cachedMessage
+		file := messageCacheFile(dir, ref.ID)
+		if err := loadJSON(file, &cached); err != nil || cached.Message == nil || cached.HistoryID != ref.HistoryID {
+			// evicted or replaced by a newer version
+			return nil, nil, time.Time{}, false
+		}
+		if cached.Version != version {
+			cached.Mail = messageMail(cached.Message)
+			cached.Version = version
+			if err := saveJSON(file, cached); err != nil {
+				log.Printf("Unable to cache message %s: %v", ref.ID, err)
+			}
+		}
+		thread.Messages = append(thread.Messages, cached.Message)
+		mails = append(mails, cached.Mail)
+		files = append(files, file)
+	}
+
+	// the eviction removes the least recently used files first
+	now := time.Now()
+	for _, file := range files {
+		os.Chtimes(file, now, now)
+	}
+	return thread, mails, index.Fetched, true
+}
+
+// cacheThread stores a fetched thread and the mails extracted from it.
+func cacheThread(account string, thread *gmail.Thread, mails []MailMessage) {
+	dir := messageCacheDir(account)
+	if dir == "" || len(mails) != len(thread.Messages) {
+		return
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("Unable to create the message cache: %v", err)
+		return
+	}
+
+	index := cachedThread{HistoryID: thread.HistoryId, Fetched: time.Now()}
+	version := messageCacheVersion()
+	for i, message := range thread.Messages {
+		cached := cachedMessage{HistoryID: message.HistoryId, Version: version, Message: message, Mail: mails[i]}
+		if err := saveJSON(messageCacheFile(dir, message.Id), cached); err != nil {
+			log.Printf("Unable to cache message %s: %v", message.Id, err)
+			return
+		}
+		index.Messages = append(index.Messages, cachedMessageRef{message.Id, message.HistoryId})
+	}
+	// the thread is written last, so it never lists a message that is
+	// not cached yet
+	if err := saveJSON(threadCacheFile(dir, thread.Id), index); err != nil {
+		log.Printf("Unable to cache thread %s: %v", thread.Id, err)
+	}
+
+	messageCacheEviction.Lock()
+	due := !messageCacheEviction.running && time.Since(messageCacheEviction.last) > messageCacheEvictInterval
+	if due {
+		messageCacheEviction.running = true
+	}
+	messageCacheEviction.Unlock()
+	if due {
+		go evictMessageCache()
+	}
+}
+
+// messageCacheFiles returns the files written by the cache. Only the
+// directories of accounts in -cache-dir are read, so pointing -cache-dir at
+// a directory used for other things as well never touches its other files.
+func messageCacheFiles() ([]messageCacheEntry, error) {
+	dirs, err := ioutil.ReadDir(*cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	files := []messageCacheEntry{}
+	for _, dir := range dirs {
+		// the directories are named by the escaped account address
+		if account, err := url.QueryUnescape(dir.Name()); !dir.IsDir() || err != nil || !strings.Contains(account, "@") {
+			continue
+		}
+		infos, err := ioutil.ReadDir(filepath.Join(*cacheDir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() && messageCacheFileName.MatchString(info.Name()) {
+				path := filepath.Join(*cacheDir, dir.Name(), info.Name())
+				files = append(files, messageCacheEntry{path, info.Size(), info.ModTime()})
+			}
+		}
+	}
+	return files, nil
+}
+
+// evictMessageCache removes the files older than -cache-max-age, and then
+// the least recently used files until the cache is smaller than
+// -cache-max-size.
+func evictMessageCache() {
+	defer func() {
+		messageCacheEviction.Lock()
+		messageCacheEviction.running = false
+		messageCacheEviction.last = time.Now()
+		messageCacheEviction.Unlock()
+	}()
+	if *cacheDir == "" {
+		return
+	}
+
+	files, err := messageCacheFiles()
+	if err != nil {
+		log.Printf("Unable to read the message cache: %v", err)
+		return
+	}
+	var size int64
+	for _, file := range files {
+		size += file.size
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+	maxSize := int64(*cacheMaxSize) << 20
+	removed, freed := 0, int64(0)
+	for _, file := range files {
+		tooOld := *cacheMaxAge > 0 && time.Since(file.used) > *cacheMaxAge
+		tooBig := *cacheMaxSize > 0 && size-freed > maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := os.Remove(file.path); err != nil {
+			log.Printf("Unable to evict %s from the message cache: %v", file.path, err)
+			continue
+		}
+		removed++
+		freed += file.size
+	}
+	if removed > 0 {
+		log.Printf("Evicted %d files (%d KB) from the message cache, %d KB left", removed, freed>>10, (size-freed)>>10)
+	}
+}
+
+// thread returns a thread with its mails. historyID is the one the thread had
+// in a list of threads, 0 if it is not known: a thread cached at it is
+// returned without asking Gmail, which would cost as much quota as fetching
+// it. If Gmail cannot be reached, the cached version is returned whatever its
+// age, with the time it was fetched; the time is zero for fresh threads.
+func (srv *gmailService) thread(threadID string, historyID uint64) (*gmail.Thread, []MailMessage, time.Time, error) {
+	if thread, mails, ok := cachedThreadAt(srv.account, threadID, historyID); ok {
+		return thread, mails, time.Time{}, nil
+	}
+
+	var thread *gmail.Thread
+	err := gmailDo(gmailThreadsGet, func() (err error) {
+		thread, err = srv.Users.Threads.Get("me", threadID).Do()
+		return err
+	})
+	if err != nil {
+		var apiErr *googleapi.Error
+		if retry, _ := retryableGmailError(err); retry || !errors.As(err, &apiErr) {
+			if thread, mails, fetched, ok := cachedThreadAny(srv.account, threadID); ok {
+				log.Printf("Gmail not reachable, showing thread %s as cached at %v: %v", threadID, fetched, err)
+				return thread, mails, fetched, nil
+			}
+		}
+		return nil, nil, time.Time{}, err
+	}
+	mails := threadMessages(thread)
+	cacheThread(srv.account, thread, mails)
+	return thread, mails, time.Time{}, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// useMessageCache points -cache-dir at a new directory for the test. The
+// background eviction is held off, the tests evict themselves.
+func useMessageCache(t *testing.T) string {
+	dir := t.TempDir()
+	messageCacheEviction.Lock()
+	messageCacheEviction.last = time.Now()
+	messageCacheEviction.Unlock()
+	cache, maxSize, maxAge := *cacheDir, *cacheMaxSize, *cacheMaxAge
+	*cacheDir = dir
+	t.Cleanup(func() { *cacheDir, *cacheMaxSize, *cacheMaxAge = cache, maxSize, maxAge })
+	return dir
+}
+
+func TestEvictMessageCacheOnlyRemovesCacheFiles(t *testing.T) {
+	dir := useMessageCache(t)
+	*cacheMaxAge = time.Hour
+
+	old := time.Now().Add(-2 * time.Hour)
+	write := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	evicted := []string{
+		write("me%40example.com/17f0a1b2c3d4e5f6.json"),
+		write("me%40example.com/thread-17f0a1b2c3d4e5f6.json"),
+		write("me%40example.com/17f0a1b2c3d4e5f6.json.tmp123"),
+	}
+	kept := []string{
+		write("token.json"),
+		write("main.go"),
+		write("src/17f0a1b2c3d4e5f6.json"),
+		write("me%40example.com/notes.txt"),
+		write("me%40example.com/sub/17f0a1b2c3d4e5f6.json"),
+	}
+
+	evictMessageCache()
+
+	for _, path := range evicted {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not evicted", path)
+		}
+	}
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+}
+
+func TestMessageCacheExtractsAgainWithOtherSettings(t *testing.T) {
+	useMessageCache(t)
+	links := *linkDomains
+	t.Cleanup(func() { *linkDomains = links })
+
+	html := base64.RawURLEncoding.EncodeToString([]byte(`<a href="https://shop.example/">Track your order</a>`))
+	thread := &gmail.Thread{Id: "a1", HistoryId: 7, Messages: []*gmail.Message{{
+		Id: "b2", ThreadId: "a1", HistoryId: 7,
+		Payload: &gmail.MessagePart{MimeType: "text/html", Body: &gmail.MessagePartBody{Data: html}},
+	}}}
+
+	*linkDomains = false
+	cacheThread("me@example.com", thread, threadMessages(thread))
+	_, mails, ok := cachedThreadAt("me@example.com", "a1", 7)
+	if !ok || mails[0].Body != "Track your order" {
+		t.Fatalf("cached mails %+v, %v", mails, ok)
+	}
+	if _, _, ok := cachedThreadAt("me@example.com", "a1", 8); ok {
+		t.Error("a thread with another historyId was read from the cache")
+	}
+
+	*linkDomains = true
+	_, mails, ok = cachedThreadAt("me@example.com", "a1", 7)
+	if !ok || mails[0].Body != "Track your order (shop.example)" {
+		t.Errorf("mails after changing -link-domains %+v, %v", mails, ok)
+	}
+}
+
+func TestThreadFromCacheWithoutGmailCall(t *testing.T) {
+	useMessageCache(t)
+	f := newFakeGmail()
+	f.threads["a1"] = &gmail.Thread{Id: "a1", HistoryId: 7, Messages: []*gmail.Message{{
+		Id: "b2", ThreadId: "a1", HistoryId: 7,
+		Payload: &gmail.MessagePart{MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: base64.RawURLEncoding.EncodeToString([]byte("Hello"))}},
+	}}}
+	srv := f.start(t)
+	srv.account = "me@example.com"
+
+	// not cached yet, and the historyId of a list is not always known
+	for _, historyID := range []uint64{7, 0} {
+		if _, mails, _, err := srv.thread("a1", historyID); err != nil || len(mails) != 1 || mails[0].Body != "Hello" {
+			t.Fatalf("thread at %d: %+v, %v", historyID, mails, err)
+		}
+	}
+	if len(f.requests) != 2 {
+		t.Fatalf("requests %v, want two fetches", f.requests)
+	}
+
+	_, mails, _, err := srv.thread("a1", 7)
+	if err != nil || len(mails) != 1 || mails[0].Body != "Hello" {
+		t.Fatalf("cached thread: %+v, %v", mails, err)
+	}
+	if len(f.requests) != 2 {
+		t.Errorf("requests %v, want none for the cached thread", f.requests[2:])
+	}
+
+	// a newer historyId fetches the thread again
+	f.threads["a1"].HistoryId = 8
+	if _, _, _, err := srv.thread("a1", 8); err != nil || len(f.requests) != 3 {
+		t.Errorf("changed thread: %v, requests %v", err, f.requests)
+	}
+}
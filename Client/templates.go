@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+)
+
+// The pages live in templates/, each defines a "content" template that is
+// rendered inside the shared layout in templates/layout.html.
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var templateFuncs = template.FuncMap{
+	// unescape decodes the HTML entities Gmail puts into snippets, they
+	// are escaped again when the snippet is written
+	"unescape": html.UnescapeString,
+}
+
+var pageTemplates = parsePageTemplates()
+
+func parsePageTemplates() map[string]*template.Template {
+	pages := map[string]*template.Template{}
+	files, err := templateFiles.ReadDir("templates")
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range files {
+		if file.Name() == "layout.html" {
+			continue
+		}
+		pages[file.Name()] = template.Must(template.New("layout.html").Funcs(templateFuncs).
+			ParseFS(templateFiles, "templates/layout.html", path.Join("templates", file.Name())))
+	}
+	return pages
+}
+
+// layoutData is what the layout renders, Page is handed to the page's
+// content template.
+type layoutData struct {
+	Title string
+	// Account is the Gmail account of the page, the account switcher is
+	// only shown on Gmail pages
+	Account  string
+	Accounts []string
+	Page     interface{}
+}
+
+// renderPage renders the page template name with data inside the layout.
+// The page is rendered into a buffer first, so a template error can still be
+// reported as an error page.
+func renderPage(w http.ResponseWriter, name, title, account string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := executePage(&buf, name, title, account, data); err != nil {
+		return newWebError(http.StatusInternalServerError, "Unable to render the page", err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+	return nil
+}
+
+func executePage(w io.Writer, name, title, account string, data interface{}) error {
+	t, ok := pageTemplates[name]
+	if !ok {
+		return fmt.Errorf("no page template %s", name)
+	}
+
+	layout := layoutData{Title: title, Account: account, Page: data}
+	if len(account) > 0 {
+		layout.Accounts = listGmailAccounts()
+	}
+	return t.Execute(w, layout)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	passphraseEnv    = "MAILCLASSIFIER_PASSPHRASE"
+	newPassphraseEnv = "MAILCLASSIFIER_NEW_PASSPHRASE"
+	tokenCipher      = "scrypt+aes-256-gcm"
+	tokenRevokeURL   = "https://oauth2.googleapis.com/revoke"
+)
+
+var errTokenLocked = errors.New("the token is encrypted, set " + passphraseEnv + " or -token-key-file")
+
+// tokenKey is the secret the token cache is encrypted with: a passphrase or
+// the contents of a key file. Without a key tokens are stored in plain text.
+type tokenKey []byte
+
+// tokenCacheKey is the key of the stored tokens, set from the command line.
+var tokenCacheKey tokenKey
+
+// tokenKeyFrom reads the key from keyFile, or else the passphrase from the
+// environment variable env.
+func tokenKeyFrom(keyFile, env string) (tokenKey, error) {
+	if len(keyFile) > 0 {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			return nil, fmt.Errorf("key file %s is empty", keyFile)
+		}
+		return tokenKey(b), nil
+	}
+	return tokenKey(os.Getenv(env)), nil
+}
+
+// encryptedToken is the on-disk format of an encrypted token.
+type encryptedToken struct {
+	Cipher string
+	Salt   []byte
+	Nonce  []byte
+	Data   []byte
+}
+
+func isEncryptedToken(b []byte) bool {
+	var enc encryptedToken
+	return json.Unmarshal(b, &enc) == nil && enc.Cipher == tokenCipher
+}
+
+// derivedKeys caches the scrypt output for the most recent salt of every key,
+// scrypt is slow on purpose and tokens are read on every Gmail request. Keys
+// are only known by their hash here.
+var derivedKeys = struct {
+	sync.Mutex
+	keys map[[sha256.Size]byte]derivedKey
+}{keys: map[[sha256.Size]byte]derivedKey{}}
+
+type derivedKey struct {
+	salt []byte
+	key  []byte
+}
+
+// recentSalt returns the salt of the cached derived key of k, nil if none is
+// cached.
+func (k tokenKey) recentSalt() []byte {
+	derivedKeys.Lock()
+	defer derivedKeys.Unlock()
+	return derivedKeys.keys[sha256.Sum256(k)].salt
+}
+
+func (k tokenKey) aead(salt []byte) (cipher.AEAD, error) {
+	id := sha256.Sum256(k)
+	derivedKeys.Lock()
+	cached, ok := derivedKeys.keys[id]
+	derivedKeys.Unlock()
+	key := cached.key
+	if !ok || !bytes.Equal(cached.salt, salt) {
+		var err error
+		key, err = scrypt.Key(k, salt, 1<<15, 8, 1, 32)
+		if err != nil {
+			return nil, err
+		}
+		derivedKeys.Lock()
+		derivedKeys.keys[id] = derivedKey{append([]byte(nil), salt...), key}
+		derivedKeys.Unlock()
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain with a new nonce. The salt of the last token read or
+// written with k is used again, so the key is not derived for every token.
+func (k tokenKey) seal(plain []byte) ([]byte, error) {
+	enc := encryptedToken{Cipher: tokenCipher, Salt: k.recentSalt()}
+	if enc.Salt == nil {
+		enc.Salt = make([]byte, 16)
+		if _, err := rand.Read(enc.Salt); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := k.aead(enc.Salt)
+	if err != nil {
+		return nil, err
+	}
+	enc.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(enc.Nonce); err != nil {
+		return nil, err
+	}
+	enc.Data = aead.Seal(nil, enc.Nonce, plain, []byte(enc.Cipher))
+	return json.Marshal(enc)
+}
+
+func (k tokenKey) open(b []byte) ([]byte, error) {
+	if len(k) == 0 {
+		return nil, errTokenLocked
+	}
+	var enc encryptedToken
+	if err := json.Unmarshal(b, &enc); err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(enc.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, enc.Nonce, enc.Data, []byte(enc.Cipher))
+	if err != nil {
+		return nil, errors.New("unable to decrypt the token, wrong passphrase or key file?")
+	}
+	return plain, nil
+}
+
+// encodeToken serializes a token for the cache file, encrypted if a key is
+// given.
+func encodeToken(token *oauth2.Token, key tokenKey) ([]byte, error) {
+	b, err := json.Marshal(token)
+	if err != nil || len(key) == 0 {
+		return b, err
+	}
+	return key.seal(b)
+}
+
+// allTokenFiles returns the token files of all accounts and scopes, including
+// those of the old single account setup.
+func allTokenFiles() ([]string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(usr.HomeDir, ".credentials")
+	perAccount, err := filepath.Glob(filepath.Join(dir, "gmail-fetcher*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := filepath.Glob(filepath.Join(dir, "gmail-fetcher*.json"))
+	if err != nil {
+		return nil, err
+	}
+	return append(perAccount, legacy...), nil
+}
+
+// rotateTokenKey re-encrypts every stored token with newKey. All tokens are
+// decrypted before the first one is written, so a wrong current key changes
+// nothing. An empty newKey stores the tokens in plain text again.
+func rotateTokenKey(newKey tokenKey) error {
+	files, err := allTokenFiles()
+	if err != nil {
+		return err
+	}
+
+	tokens := map[string]*oauth2.Token{}
+	for _, file := range files {
+		tok, _, err := readTokenFile(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		tokens[file] = tok
+	}
+
+	for file, tok := range tokens {
+		b, err := encodeToken(tok, newKey)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(file, b); err != nil {
+			return err
+		}
+		log.Printf("Re-encrypted %s", file)
+	}
+	tokenCacheKey = newKey
+	return nil
+}
+
+// revokeTokens revokes the stored tokens of account at Google and deletes
+// them, "all" does so for every account. Tokens that cannot be decrypted or
+// revoked are deleted anyway.
+func revokeTokens(account string) error {
+	files, err := allTokenFiles()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, file := range files {
+		name, _ := url.QueryUnescape(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if account != "all" && name != account {
+			continue
+		}
+		found = true
+
+		if tok, _, err := readTokenFile(file); err != nil {
+			log.Printf("Unable to read %s, deleting it without revoking: %v", file, err)
+		} else if err := revokeToken(tok); err != nil {
+			log.Printf("Unable to revoke the token in %s: %v", file, err)
+		}
+
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		log.Printf("Deleted %s", file)
+	}
+
+	if !found {
+		return fmt.Errorf("no stored token for %s", account)
+	}
+	return nil
+}
+
+// revokeToken revokes the refresh token, which invalidates its access tokens
+// as well.
+func revokeToken(tok *oauth2.Token) error {
+	value := tok.RefreshToken
+	if len(value) == 0 {
+		value = tok.AccessToken
+	}
+	resp, err := http.PostForm(tokenRevokeURL, url.Values{"token": {value}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
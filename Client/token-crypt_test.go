@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenKeySealOpen(t *testing.T) {
+	key := tokenKey("correct horse battery staple")
+	first, err := key.seal([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := key.seal([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, second) {
+		t.Error("two tokens sealed the same")
+	}
+	for plain, sealed := range map[string][]byte{"first": first, "second": second} {
+		if got, err := key.open(sealed); err != nil || string(got) != plain {
+			t.Errorf("opened %q, %v, want %q", got, err, plain)
+		}
+	}
+	if _, err := tokenKey("wrong").open(first); err == nil {
+		t.Error("opened a token with the wrong key")
+	}
+
+	// the key is derived once for both
+	var a, b encryptedToken
+	if err := json.Unmarshal(first, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(second, &b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Salt, b.Salt) || bytes.Equal(a.Nonce, b.Nonce) {
+		t.Errorf("salts %x and %x, nonces %x and %x", a.Salt, b.Salt, a.Nonce, b.Nonce)
+	}
+	if salt := key.recentSalt(); !bytes.Equal(salt, a.Salt) {
+		t.Errorf("cached salt %x, want %x", salt, a.Salt)
+	}
+}
+
+func TestReadTokenFileLeavesFileAlone(t *testing.T) {
+	cacheKey := tokenCacheKey
+	tokenCacheKey = tokenKey("passphrase")
+	defer func() { tokenCacheKey = cacheKey }()
+
+	file := filepath.Join(t.TempDir(), "me%40example.com.json")
+	plain := []byte(`{"access_token":"a","refresh_token":"r"}`)
+	if err := ioutil.WriteFile(file, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tok, encrypted, err := readTokenFile(file)
+	if err != nil || encrypted || tok.RefreshToken != "r" {
+		t.Fatalf("read %+v, encrypted %v, %v", tok, encrypted, err)
+	}
+	if b, _ := ioutil.ReadFile(file); !bytes.Equal(b, plain) {
+		t.Errorf("readTokenFile changed the file to %s", b)
+	}
+
+	// tokenFromFile encrypts it in place
+	if tok, err := tokenFromFile(file); err != nil || tok.RefreshToken != "r" {
+		t.Fatalf("read %+v, %v", tok, err)
+	}
+	b, _ := ioutil.ReadFile(file)
+	if !isEncryptedToken(b) {
+		t.Fatalf("token not encrypted: %s", b)
+	}
+	var read *oauth2.Token
+	if read, encrypted, err = readTokenFile(file); err != nil || !encrypted || read.AccessToken != "a" {
+		t.Errorf("read back %+v, encrypted %v, %v", read, encrypted, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// webError is an error with the HTTP status it should be answered with and a
+// message that can be shown to the user. The underlying error is only logged.
+type webError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *webError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *webError) Unwrap() error { return e.Err }
+
+// newWebError wraps err with a status and a message for the user.
+func newWebError(status int, message string, err error) *webError {
+	return &webError{Status: status, Message: message, Err: err}
+}
+
+// gmailError wraps an error returned by the Gmail API. Missing threads stay a
+// 404 and exhausted quota a 429, everything else is the upstream's fault.
+func gmailError(message string, err error) *webError {
+	status := http.StatusBadGateway
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusNotFound, http.StatusTooManyRequests:
+			status = apiErr.Code
+		case http.StatusUnauthorized, http.StatusForbidden:
+			status = http.StatusForbidden
+		}
+	}
+	return newWebError(status, message, err)
+}
+
+// classifierUnavailable reports whether err is the classification server not
+// running, which fails every classification until it is started.
+func classifierUnavailable(err error) bool {
+	var webErr *webError
+	return errors.As(err, &webErr) && webErr.Status == http.StatusServiceUnavailable
+}
+
+// webHandler is an HTTP handler that returns its error instead of writing it,
+// so every page reports errors the same way. Nothing must be written to w
+// before an error is returned.
+type webHandler func(http.ResponseWriter, *http.Request) error
+
+func (h webHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		writeWebError(w, r, err)
+	}
+}
+
+// wantsJSON reports whether the client asked for a JSON response, either
+// with an Accept header or with ?format=json.
+func wantsJSON(r *http.Request) bool {
+	return r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeWebError logs err and answers with its status, as an error page or as
+// JSON. Errors that are not a webError become a 500 with a generic message.
+func writeWebError(w http.ResponseWriter, r *http.Request, err error) {
+	var webErr *webError
+	if !errors.As(err, &webErr) {
+		webErr = newWebError(http.StatusInternalServerError, "Internal error", err)
+	}
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(webErr.Status)
+		json.NewEncoder(w).Encode(struct {
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+		}{webErr.Status, webErr.Message})
+		return
+	}
+
+	page := struct {
+		Status     int
+		StatusText string
+		Message    string
+	}{webErr.Status, http.StatusText(webErr.Status), webErr.Message}
+	var buf bytes.Buffer
+	if err := executePage(&buf, "error.html", "Error", "", page); err != nil {
+		log.Printf("Unable to render the error page: %v", err)
+		http.Error(w, webErr.Message, webErr.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(webErr.Status)
+	buf.WriteTo(w)
+}